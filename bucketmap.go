@@ -1,8 +1,17 @@
 package bucketmap
 
 import (
+	"cmp"
+	"container/heap"
+	"context"
+	"fmt"
+	"maps"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/eachain/unsafehash"
 )
@@ -10,6 +19,116 @@ import (
 type bucket[K comparable, V any] struct {
 	sync.RWMutex
 	m map[K]V
+
+	reserved map[K]*reservation[V]
+
+	// versions holds the versions of the entries if the Map tracks versions.
+	versions map[K]uint64
+
+	// read is a copy of m for Load to read without locking,
+	// if the Map is read optimized. It is made by Load,
+	// and dropped by every write, moving the bucket included.
+	read atomic.Pointer[map[K]V]
+
+	// building is set while a Load is making read,
+	// so that the others look up m instead of making copies of their own.
+	building atomic.Bool
+
+	// moved reports whether the entries have been moved to a new table
+	// by resizing. A moved bucket is left as is and never written again.
+	moved bool
+
+	// The padding rounds the size up to a multiple of cacheLine,
+	// so that adjacent buckets never share a cache line,
+	// and locking one does not slow down accessing another.
+	_ [(cacheLine - unsafe.Sizeof(bucketLayout{})%cacheLine) % cacheLine]byte
+}
+
+// cacheLine is the size of a cache line, doubled for CPUs
+// prefetching lines in pairs, such as recent x86 ones.
+const cacheLine = 128
+
+// bucketLayout has the same fields as bucket but the padding,
+// with the same sizes, as none of them depends on K or V.
+type bucketLayout struct {
+	sync.RWMutex
+	m        map[int]int
+	reserved map[int]int
+	versions map[int]uint64
+	read     atomic.Pointer[int]
+	building atomic.Bool
+	moved    bool
+}
+
+// pairs returns a copy of the entries in the bucket.
+func (b *bucket[K, V]) pairs() []Pair[K, V] {
+	b.RLock()
+	defer b.RUnlock()
+	if len(b.m) == 0 {
+		return nil
+	}
+	pairs := make([]Pair[K, V], 0, len(b.m))
+	for k, v := range b.m {
+		pairs = append(pairs, Pair[K, V]{k, v})
+	}
+	return pairs
+}
+
+type reservation[V any] struct {
+	done  chan struct{}
+	value V
+	ok    bool
+
+	// err is the error the value failed with, if canceled by failLoad.
+	err error
+}
+
+type table[K comparable, V any] struct {
+	buckets []bucket[K, V]
+	hash    unsafehash.HashFunc[K]
+
+	// mask is len(buckets)-1 if len(buckets) is a power of two,
+	// so that keys are routed by bitmask instead of modulo.
+	mask    uint64
+	bitmask bool
+}
+
+// newTable makes a table of n buckets routing keys by hash,
+// or by a randomly seeded hash of the whole key if hash is nil.
+func newTable[K comparable, V any](n int, hash unsafehash.HashFunc[K]) *table[K, V] {
+	if n == 1 {
+		hash = func(k K) uint64 { return 0 }
+	} else if hash == nil {
+		hash = unsafehash.Map[K]()
+	}
+	return &table[K, V]{
+		buckets: make([]bucket[K, V], n),
+		hash:    hash,
+		mask:    uint64(n - 1),
+		bitmask: n&(n-1) == 0,
+	}
+}
+
+func (t *table[K, V]) index(key K) int {
+	if t.bitmask {
+		return int(t.hash(key) & t.mask)
+	}
+	return int(t.hash(key) % uint64(len(t.buckets)))
+}
+
+func (t *table[K, V]) get(key K) *bucket[K, V] {
+	return &t.buckets[t.index(key)]
+}
+
+// group groups the indexes of keys by the buckets they belong to.
+// Groups are allocated only for the buckets with keys.
+func (t *table[K, V]) group(keys []K) [][]int {
+	groups := make([][]int, len(t.buckets))
+	for i, key := range keys {
+		j := t.index(key)
+		groups[j] = append(groups[j], i)
+	}
+	return groups
 }
 
 // Map is like a Go map[K]V but is safe for concurrent use
@@ -18,82 +137,529 @@ type bucket[K comparable, V any] struct {
 // The Map type splits keys to different buckets.
 // It like a simple Go map[K]V when buckets size is 1.
 type Map[K comparable, V any] struct {
-	buckets []bucket[K, V]
-	hash    unsafehash.HashFunc[K]
+	// mu is held exclusively while resizing,
+	// and shared by operations accessing all the buckets,
+	// so that they see the same table throughout.
+	mu    sync.RWMutex
+	table atomic.Pointer[table[K, V]]
+	hash  unsafehash.HashFunc[K]
+
+	// size is the number of entries, updated along with the entries.
+	size atomic.Int64
+
+	// transitions counts the times size has become or left zero,
+	// and reported the transitions reported to onEmpty.
+	// The Map starts empty and transitions alternate,
+	// so the Map is empty after an even number of them.
+	transitions atomic.Uint64
+	reported    atomic.Uint64
+	emptyMu     sync.Mutex
+	onEmpty     func(empty bool)
+
+	normalizeKey func(K) K
+
+	measureWait bool
+	totalWait   atomic.Int64
+	maxWait     atomic.Int64
+
+	recoverCallbacks bool
+
+	trackVersions bool
+	version       atomic.Uint64
+
+	watcher atomic.Pointer[func(Event[K, V])]
+
+	readOptimized bool
+
+	countOps bool
+	ops      opCounts
+
+	keyToString   func(K) (string, error)
+	keyFromString func(string) (K, error)
+}
+
+// Options configures a Map made by MakeWithOptions.
+// The zero value configures the same Map as Make.
+type Options[K comparable] struct {
+	// Buckets is the number of buckets, default 31.
+	Buckets int
+
+	// Hash, if not nil, hashes keys to route them to buckets,
+	// instead of hashing the whole key with a random seed.
+	// It is called with normalized keys.
+	Hash unsafehash.HashFunc[K]
+
+	// NormalizeKey, if not nil, maps every key passed to the Map
+	// to its normalized form, such as strings.ToLower,
+	// so that keys with the same normalized form refer to the same entry.
+	// Keys are stored normalized, so Iter and the like yield normalized keys.
+	// Normalizing a normalized key must not change it.
+	NormalizeKey func(K) K
+
+	// MeasureWait enables measuring the time operations on single keys
+	// spend waiting to lock their buckets, as reported by WaitStats.
+	// Only contended locks are timed, so uncontended ones cost next to nothing.
+	MeasureWait bool
+
+	// RecoverCallbacks makes the methods calling a callback for every entry,
+	// such as TransformInPlace, recover from panics of the callback,
+	// leave the entry it panics on unchanged and go on with the others,
+	// so that a buggy callback does not break a long-running sweep.
+	// Other methods let panics of callbacks propagate,
+	// after releasing the locks they hold, so the Map remains usable.
+	// ComputeSafe always reports a panic of its callback as a *PanicError.
+	RecoverCallbacks bool
+
+	// TrackVersions stamps every entry with the version of the Map
+	// when it is written last, as reported by Version,
+	// so that IterSince yields the entries written since a given version.
+	TrackVersions bool
+
+	// ReadOptimized makes Load lock-free for read-heavy workloads,
+	// by reading a copy of the bucket, made by the first Load after a write
+	// to the bucket. So, after writing to a bucket, the next Load copies
+	// the whole bucket, which pays off only if writes are rare,
+	// and buckets are small.
+	ReadOptimized bool
+
+	// CountOps makes the Map count loads, hits and misses of Load,
+	// stores and deletions, as reported by Metrics.
+	// The counters are shared by all the buckets, so counting costs
+	// some contention under heavy concurrent use.
+	CountOps bool
+
+	// KeyToString and KeyFromString, if not nil, convert keys to and from
+	// the strings MarshalJSON and UnmarshalJSON use as JSON object keys,
+	// so that keys encoding/json cannot use, such as structs, can be encoded.
+	// KeyToString must map different keys to different strings,
+	// and KeyFromString must invert it.
+	KeyToString   func(K) (string, error)
+	KeyFromString func(string) (K, error)
 }
 
 // Make makes a Map with default 31 buckets.
 func Make[K comparable, V any](buckets ...int) *Map[K, V] {
+	var opts Options[K]
+	if len(buckets) > 0 {
+		opts.Buckets = buckets[0]
+	}
+	return MakeWithOptions[K, V](opts)
+}
+
+// MakeWithOptions makes a Map configured by opts.
+func MakeWithOptions[K comparable, V any](opts Options[K]) *Map[K, V] {
 	n := 31
-	if len(buckets) > 0 && buckets[0] > 0 {
-		n = buckets[0]
+	if opts.Buckets > 0 {
+		n = opts.Buckets
 	}
-	var hash unsafehash.HashFunc[K]
-	if n == 1 {
-		hash = func(k K) uint64 { return 0 }
-	} else {
-		hash = unsafehash.Map[K]()
+	m := &Map[K, V]{
+		hash:         opts.Hash,
+		normalizeKey: opts.NormalizeKey,
+		measureWait:  opts.MeasureWait,
+
+		recoverCallbacks: opts.RecoverCallbacks,
+		trackVersions:    opts.TrackVersions,
+		readOptimized:    opts.ReadOptimized,
+		countOps:         opts.CountOps,
+		keyToString:      opts.KeyToString,
+		keyFromString:    opts.KeyFromString,
 	}
-	return &Map[K, V]{
-		buckets: make([]bucket[K, V], n),
-		hash:    hash,
+	m.table.Store(newTable[K, V](n, m.hash))
+	return m
+}
+
+// MakeWithHash makes a Map of buckets, default 31 if buckets <= 0,
+// routing keys by hash, such as one hashing only the fields of a key
+// meaningful for distribution.
+// A nil hash falls back to the default one, as in Make.
+func MakeWithHash[K comparable, V any](buckets int, hash unsafehash.HashFunc[K]) *Map[K, V] {
+	return MakeWithOptions[K, V](Options[K]{Buckets: buckets, Hash: hash})
+}
+
+// FromSlices makes a Map pairing keys with values positionally,
+// with default 31 buckets.
+// The later value wins if a key appears more than once.
+// It returns an error if keys and values differ in length.
+func FromSlices[K comparable, V any](keys []K, values []V, buckets ...int) (*Map[K, V], error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("bucketmap: %d keys but %d values", len(keys), len(values))
+	}
+	m := Make[K, V](buckets...)
+	for i, key := range keys {
+		m.Store(key, values[i])
+	}
+	return m, nil
+}
+
+// normalize returns the normalized form of a key.
+func (m *Map[K, V]) normalize(key K) K {
+	if m.normalizeKey != nil {
+		return m.normalizeKey(key)
+	}
+	return key
+}
+
+// normalizeAll returns the normalized forms of keys.
+func (m *Map[K, V]) normalizeAll(keys []K) []K {
+	if m.normalizeKey == nil {
+		return keys
+	}
+	normalized := make([]K, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalizeKey(key)
+	}
+	return normalized
+}
+
+// lock locks the bucket a key belongs to for writing.
+// It returns the bucket and the normalized key.
+func (m *Map[K, V]) lock(key K) (*bucket[K, V], K) {
+	key = m.normalize(key)
+	for {
+		bkt := m.table.Load().get(key)
+		m.lockBucket(bkt)
+		if !bkt.moved {
+			return bkt, key
+		}
+		bkt.Unlock()
+	}
+}
+
+// rlock locks the bucket a key belongs to for reading.
+// It returns the bucket and the normalized key.
+func (m *Map[K, V]) rlock(key K) (*bucket[K, V], K) {
+	key = m.normalize(key)
+	for {
+		bkt := m.table.Load().get(key)
+		m.rlockBucket(bkt)
+		if !bkt.moved {
+			return bkt, key
+		}
+		bkt.RUnlock()
+	}
+}
+
+func (m *Map[K, V]) lockBucket(bkt *bucket[K, V]) {
+	if !m.measureWait {
+		bkt.Lock()
+	} else if !bkt.TryLock() {
+		start := time.Now()
+		bkt.Lock()
+		m.addWait(time.Since(start))
+	}
+}
+
+func (m *Map[K, V]) rlockBucket(bkt *bucket[K, V]) {
+	if !m.measureWait {
+		bkt.RLock()
+	} else if !bkt.TryRLock() {
+		start := time.Now()
+		bkt.RLock()
+		m.addWait(time.Since(start))
+	}
+}
+
+func (m *Map[K, V]) addWait(wait time.Duration) {
+	m.totalWait.Add(int64(wait))
+	for {
+		max := m.maxWait.Load()
+		if int64(wait) <= max || m.maxWait.CompareAndSwap(max, int64(wait)) {
+			return
+		}
+	}
+}
+
+// guard calls fn, recovering from its panic if the Map recovers callbacks.
+// It reports whether fn returns normally.
+func (m *Map[K, V]) guard(fn func()) (ok bool) {
+	if m.recoverCallbacks {
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+	}
+	fn()
+	return true
+}
+
+// PanicError is the error reporting a panic of a callback.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("bucketmap: callback panicked: %v", e.Value)
+}
+
+// WaitStats returns the total and the longest time operations on single keys
+// have spent waiting to lock their buckets.
+// It reports zeros unless the Map is made with MeasureWait.
+func (m *Map[K, V]) WaitStats() (totalWait time.Duration, maxWait time.Duration) {
+	return time.Duration(m.totalWait.Load()), time.Duration(m.maxWait.Load())
+}
+
+// put sets the value for a key in bkt, which must be write locked.
+func (m *Map[K, V]) put(bkt *bucket[K, V], key K, value V) {
+	m.reportStore(bkt, key, value)
+	m.set(bkt, key, value)
+}
+
+// reportStore reports storing value for a key in bkt to the watcher, if any.
+func (m *Map[K, V]) reportStore(bkt *bucket[K, V], key K, value V) {
+	if fn := m.watch(); fn != nil {
+		old, loaded := bkt.m[key]
+		fn(Event[K, V]{Op: OpStore, Key: key, Old: old, Loaded: loaded, New: value})
+	}
+}
+
+// set is put without reporting to the watcher.
+func (m *Map[K, V]) set(bkt *bucket[K, V], key K, value V) {
+	if bkt.m == nil {
+		bkt.m = make(map[K]V)
+	}
+	m.dropRead(bkt)
+	n := len(bkt.m)
+	bkt.m[key] = value
+	if len(bkt.m) > n {
+		m.addSize(1)
+	}
+	if m.countOps {
+		m.ops.stores.Add(1)
+	}
+	if m.trackVersions {
+		if bkt.versions == nil {
+			bkt.versions = make(map[K]uint64)
+		}
+		bkt.versions[key] = m.version.Add(1)
+	}
+}
+
+// remove deletes the value for a key from bkt, which must be write locked.
+// It returns the number of entries left in the Map,
+// and whether the key was present.
+func (m *Map[K, V]) remove(bkt *bucket[K, V], key K) (remaining int, deleted bool) {
+	if fn := m.watch(); fn != nil {
+		if old, ok := bkt.m[key]; ok {
+			fn(Event[K, V]{Op: OpDelete, Key: key, Old: old, Loaded: true})
+		}
+	}
+	m.dropRead(bkt)
+	n := len(bkt.m)
+	delete(bkt.m, key)
+	delete(bkt.versions, key)
+	if len(bkt.m) < n {
+		m.countDeletes(1)
+		return m.addSize(-1), true
+	}
+	return int(m.size.Load()), false
+}
+
+// countDeletes counts n entries deleted if the Map counts operations.
+func (m *Map[K, V]) countDeletes(n int) {
+	if m.countOps {
+		m.ops.deletes.Add(int64(n))
+	}
+}
+
+// addSize adds delta to the number of entries and returns the new number.
+// If the Map becomes empty or non-empty, the transition is counted
+// to be reported by notifyEmpty. Every transition is seen by exactly one
+// addSize, whose addition crosses zero.
+func (m *Map[K, V]) addSize(delta int) int {
+	n := m.size.Add(int64(delta))
+	if (n == 0) != (n == int64(delta)) {
+		m.transitions.Add(1)
+	}
+	return int(n)
+}
+
+// withBucket calls fn with bkt locked for writing,
+// and unlocks bkt by unlock even if fn panics.
+// It reports false, without calling fn, if bkt has been moved.
+func (m *Map[K, V]) withBucket(bkt *bucket[K, V], fn func()) bool {
+	bkt.Lock()
+	if bkt.moved {
+		bkt.Unlock()
+		return false
+	}
+	defer m.unlock(bkt)
+	fn()
+	return true
+}
+
+// unlock unlocks bkt locked for writing, and then calls notifyEmpty.
+func (m *Map[K, V]) unlock(bkt *bucket[K, V]) {
+	bkt.Unlock()
+	m.notifyEmpty()
+}
+
+// notifyEmpty calls the callback registered by OnEmptyChange
+// if a transition is pending.
+// It must be called without holding any lock of the Map.
+func (m *Map[K, V]) notifyEmpty() {
+	if m.transitions.Load() != m.reported.Load() {
+		m.reportEmpty()
+	}
+}
+
+// reportEmpty calls the callback registered by OnEmptyChange
+// once for every transition not reported yet, in order.
+// Whoever reports transitions loops until none is pending,
+// so a concurrent caller does not wait, nor does a callback calling into the Map.
+func (m *Map[K, V]) reportEmpty() {
+	for m.transitions.Load() != m.reported.Load() && m.emptyMu.TryLock() {
+		for m.reported.Load() < m.transitions.Load() {
+			if r := m.reported.Add(1); m.onEmpty != nil {
+				m.onEmpty(r%2 == 0)
+			}
+		}
+		m.emptyMu.Unlock()
 	}
 }
 
-func (m *Map[K, V]) get(key K) *bucket[K, V] {
-	return &m.buckets[m.hash(key)%uint64(len(m.buckets))]
+// OnEmptyChange registers fn to be called with true when the Map becomes empty,
+// and with false when it becomes non-empty, replacing any fn registered before.
+// fn is called after the write causing the transition releases its locks,
+// so it may call into the Map, but not OnEmptyChange.
+// fn is called exactly once for every transition after OnEmptyChange,
+// in the order the transitions happen, so calls alternate between true and false,
+// even when transitions follow each other before fn is called,
+// in which case fn may be called after the Map has changed again.
+// Calls are serialized.
+func (m *Map[K, V]) OnEmptyChange(fn func(empty bool)) {
+	m.emptyMu.Lock()
+	m.onEmpty = fn
+	m.reported.Store(m.transitions.Load())
+	m.emptyMu.Unlock()
+}
+
+// resize moves all the entries to a new table of n buckets.
+// It must be called with m.mu locked.
+func (m *Map[K, V]) resize(n int) {
+	old := m.table.Load()
+	t := newTable[K, V](n, m.hash)
+	for i := range old.buckets {
+		old.buckets[i].Lock()
+	}
+	for i := range old.buckets {
+		ob := &old.buckets[i]
+		for k, v := range ob.m {
+			bkt := t.get(k)
+			if bkt.m == nil {
+				bkt.m = make(map[K]V)
+			}
+			bkt.m[k] = v
+		}
+		for k, v := range ob.versions {
+			bkt := t.get(k)
+			if bkt.versions == nil {
+				bkt.versions = make(map[K]uint64)
+			}
+			bkt.versions[k] = v
+		}
+		for k, r := range ob.reserved {
+			bkt := t.get(k)
+			if bkt.reserved == nil {
+				bkt.reserved = make(map[K]*reservation[V])
+			}
+			bkt.reserved[k] = r
+		}
+		ob.moved = true
+		m.dropRead(ob)
+	}
+	m.table.Store(t)
+	for i := range old.buckets {
+		old.buckets[i].Unlock()
+	}
 }
 
 // Load returns the value stored in the map for a key,
 // or zero value if no value is present.
 // The ok result indicates whether value was found in the map.
 func (m *Map[K, V]) Load(key K) (value V, ok bool) {
-	bkt := m.get(key)
-	bkt.RLock()
+	if m.countOps {
+		defer func() { m.ops.load(ok) }()
+	}
+	if m.readOptimized {
+		return m.loadRead(key)
+	}
+	bkt, key := m.rlock(key)
 	value, ok = bkt.m[key]
 	bkt.RUnlock()
 	return
 }
 
+// loadRead is Load of a read optimized Map.
+func (m *Map[K, V]) loadRead(key K) (value V, ok bool) {
+	key = m.normalize(key)
+	if read := m.table.Load().get(key).read.Load(); read != nil {
+		value, ok = (*read)[key]
+		return
+	}
+	bkt, key := m.rlock(key)
+	defer bkt.RUnlock()
+	value, ok = bkt.m[key]
+	if bkt.read.Load() == nil && bkt.building.CompareAndSwap(false, true) {
+		// Writes are excluded by the read lock, so the copy is up to date.
+		read := maps.Clone(bkt.m)
+		bkt.read.CompareAndSwap(nil, &read)
+		bkt.building.Store(false)
+	}
+	return
+}
+
+// dropRead drops the copy of bkt for Load to read. bkt must be write locked.
+func (m *Map[K, V]) dropRead(bkt *bucket[K, V]) {
+	if m.readOptimized {
+		bkt.read.Store(nil)
+	}
+}
+
 // Store sets the value for a key.
 func (m *Map[K, V]) Store(key K, value V) {
-	bkt := m.get(key)
-	bkt.Lock()
-	if bkt.m == nil {
-		bkt.m = make(map[K]V)
-	}
-	bkt.m[key] = value
-	bkt.Unlock()
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	m.put(bkt, key, value)
 }
 
 // Delete deletes the value for a key.
 func (m *Map[K, V]) Delete(key K) {
-	bkt := m.get(key)
-	bkt.Lock()
-	delete(bkt.m, key)
-	bkt.Unlock()
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	m.remove(bkt, key)
 }
 
 // Clear deletes all the entries, resulting in an empty Map.
 func (m *Map[K, V]) Clear() {
-	for i := 0; i < len(m.buckets); i++ {
-		b := &m.buckets[i]
-		b.Lock()
-		clear(b.m)
-		b.Unlock()
+	defer m.notifyEmpty()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		b := &t.buckets[i]
+		func() {
+			b.Lock()
+			defer b.Unlock()
+			// Deleting one by one keeps the entries not reported yet
+			// if the watcher panics.
+			for k := range b.m {
+				m.remove(b, k)
+			}
+		}()
 	}
 }
 
 // LoadAndDelete deletes the value for a key, returning the previous value if any.
 // The loaded result reports whether the key was present.
 func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
-	bkt := m.get(key)
-	bkt.Lock()
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
 	value, loaded = bkt.m[key]
 	if loaded {
-		delete(bkt.m, key)
+		m.remove(bkt, key)
 	}
-	bkt.Unlock()
 	return
 }
 
@@ -101,35 +667,33 @@ func (m *Map[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
 // Otherwise, it stores and returns the given value.
 // The loaded result is true if the value was loaded, false if stored.
 func (m *Map[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
-	bkt := m.get(key)
-	bkt.Lock()
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
 	actual, loaded = bkt.m[key]
 	if !loaded {
-		if bkt.m == nil {
-			bkt.m = make(map[K]V)
-		}
-		bkt.m[key] = value
+		m.put(bkt, key, value)
 		actual = value
 	}
-	bkt.Unlock()
 	return
 }
 
+// LoadOrInsert is like LoadOrStore, but the inserted result reports
+// the inverse of loaded: true if the value was stored, false if loaded.
+func (m *Map[K, V]) LoadOrInsert(key K, value V) (actual V, inserted bool) {
+	actual, loaded := m.LoadOrStore(key, value)
+	return actual, !loaded
+}
+
 // LoadOrStoreFunc returns the existing value for the key if present.
 // Otherwise, it stores and returns the given value which is returned by newValue func.
 // The loaded result is true if the value was loaded, false if stored.
 func (m *Map[K, V]) LoadOrStoreFunc(key K, newValue func() V) (actual V, loaded bool) {
-	bkt := m.get(key)
-	bkt.Lock()
-	defer bkt.Unlock()
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
 	actual, loaded = bkt.m[key]
 	if !loaded {
-		if bkt.m == nil {
-			bkt.m = make(map[K]V)
-		}
-		value := newValue()
-		bkt.m[key] = value
-		actual = value
+		actual = newValue()
+		m.put(bkt, key, actual)
 	}
 	return
 }
@@ -137,50 +701,1662 @@ func (m *Map[K, V]) LoadOrStoreFunc(key K, newValue func() V) (actual V, loaded
 // Swap swaps the value for a key and returns the previous value if any.
 // The loaded result reports whether the key was present.
 func (m *Map[K, V]) Swap(key K, value V) (previous V, loaded bool) {
-	bkt := m.get(key)
-	bkt.Lock()
-	defer bkt.Unlock()
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
 	previous, loaded = bkt.m[key]
-	if bkt.m == nil {
-		bkt.m = make(map[K]V)
+	m.put(bkt, key, value)
+	return
+}
+
+// SwapIf swaps the value for a key only if the key is present
+// and pred reports true for the previous value.
+// It returns the previous value if any.
+// The swapped result reports whether the value was swapped.
+func (m *Map[K, V]) SwapIf(key K, pred func(old V) bool, new V) (previous V, swapped bool) {
+	bkt, key := m.lock(key)
+	defer bkt.Unlock()
+	previous, loaded := bkt.m[key]
+	if loaded && pred(previous) {
+		m.put(bkt, key, new)
+		swapped = true
 	}
-	bkt.m[key] = value
 	return
 }
 
 // Iter returns an iterator over key-value pairs in the Map.
+// The buckets are visited in random order, and the entries of each bucket
+// are copied under its read lock before any of them is yielded,
+// so no lock is held while yielding, and yield may call into the Map freely.
+// The iteration is not affected by writes to a bucket,
+// Clear included, once it has started yielding from the bucket.
+// The copy costs memory proportional to the size of a bucket.
 func (m *Map[K, V]) Iter() func(yield func(K, V) bool) {
-	order := make([]int, len(m.buckets))
+	t := m.table.Load()
+	order := shuffled(len(t.buckets))
+
+	return func(yield func(K, V) bool) {
+		for _, i := range order {
+			for _, p := range t.buckets[i].pairs() {
+				if !yield(p.Key, p.Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// IterStable is the same as Iter, which copies the entries of each bucket
+// before yielding them, too.
+func (m *Map[K, V]) IterStable() func(yield func(K, V) bool) {
+	return m.Iter()
+}
+
+// shuffled returns the integers in [0, n) in random order.
+func shuffled(n int) []int {
+	order := make([]int, n)
 	for i := range order {
 		order[i] = i
 	}
 	rand.Shuffle(len(order), func(i, j int) {
 		order[i], order[j] = order[j], order[i]
 	})
+	return order
+}
 
-	return func(yield func(K, V) bool) {
-		for _, i := range order {
-			broken := false
-			bkt := &m.buckets[i]
-			f := func(k K, v V) bool {
-				bkt.RUnlock()
-				defer bkt.RLock()
-				return yield(k, v)
+// Pair is a key-value pair stored in a Map.
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+// BottomN returns the n entries with the smallest values in the Map,
+// sorted in ascending order of value.
+// It returns fewer than n entries if the Map holds fewer than n.
+func BottomN[K comparable, V cmp.Ordered](m *Map[K, V], n int) []Pair[K, V] {
+	if n <= 0 {
+		return nil
+	}
+
+	// h is a max-heap holding the n smallest values seen so far,
+	// the largest of them on top.
+	h := make(maxHeap[K, V], 0, n)
+	m.mu.RLock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		for k, v := range bkt.m {
+			if len(h) < n {
+				heap.Push(&h, Pair[K, V]{k, v})
+			} else if v < h[0].Value {
+				h[0] = Pair[K, V]{k, v}
+				heap.Fix(&h, 0)
+			}
+		}
+		bkt.RUnlock()
+	}
+	m.mu.RUnlock()
+
+	pairs := make([]Pair[K, V], len(h))
+	for i := len(pairs) - 1; i >= 0; i-- {
+		pairs[i] = heap.Pop(&h).(Pair[K, V])
+	}
+	return pairs
+}
+
+type maxHeap[K comparable, V cmp.Ordered] []Pair[K, V]
+
+func (h maxHeap[K, V]) Len() int           { return len(h) }
+func (h maxHeap[K, V]) Less(i, j int) bool { return h[i].Value > h[j].Value }
+func (h maxHeap[K, V]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *maxHeap[K, V]) Push(x any) { *h = append(*h, x.(Pair[K, V])) }
+
+func (h *maxHeap[K, V]) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// DrainTo removes the entries bucket by bucket and sends them to the returned channel.
+// The channel is closed when the Map has been drained or ctx is done.
+// The caller must keep receiving until the channel is closed,
+// or cancel ctx to stop early.
+// Entries removed from a bucket but not yet sent when ctx is done
+// are put back, unless their keys have been stored again meanwhile.
+func (m *Map[K, V]) DrainTo(ctx context.Context) <-chan Pair[K, V] {
+	ch := make(chan Pair[K, V])
+	go func() {
+		defer close(ch)
+		t := m.table.Load()
+		for i := 0; i < len(t.buckets); i++ {
+			if ctx.Err() != nil {
+				return
+			}
+
+			bkt := &t.buckets[i]
+			bkt.Lock()
+			if bkt.moved {
+				// Resized meanwhile, start over with the new table,
+				// where the drained buckets stay nearly empty.
+				bkt.Unlock()
+				t = m.table.Load()
+				i = -1
+				continue
 			}
-			func() {
-				bkt.RLock()
-				defer bkt.RUnlock()
+			entries := bkt.m
+			reportDeletes(m.watch(), entries)
+			bkt.m, bkt.versions = nil, nil
+			m.dropRead(bkt)
+			m.addSize(-len(entries))
+			m.countDeletes(len(entries))
+			m.unlock(bkt)
 
-				for k, v := range bkt.m {
-					if !f(k, v) {
-						broken = true
-						return
+			for k, v := range entries {
+				select {
+				case ch <- Pair[K, V]{k, v}:
+					delete(entries, k)
+				case <-ctx.Done():
+					for k, v := range entries {
+						m.LoadOrStore(k, v)
 					}
+					return
 				}
-			}()
-			if broken {
-				break
 			}
 		}
+	}()
+	return ch
+}
+
+// Reserve reserves an absent key, so that only one of the goroutines
+// needing its value computes it.
+// If the key is neither present nor reserved, Reserve reserves it and
+// reports reserved true; the caller is expected to compute the value
+// and then Fulfill the key.
+// The returned wait func blocks until the key is fulfilled and returns its value.
+// If the key is already present, wait returns its value immediately.
+func (m *Map[K, V]) Reserve(key K) (reserved bool, wait func() (V, bool)) {
+	value, ok, r, reserved := m.reserve(key)
+	if ok {
+		return false, func() (V, bool) { return value, true }
+	}
+	return reserved, func() (V, bool) {
+		<-r.done
+		return r.value, r.ok
+	}
+}
+
+// reserve returns the value for a key if present.
+// Otherwise, it returns the reservation of the key,
+// which reserved reports whether it has just made.
+func (m *Map[K, V]) reserve(key K) (value V, ok bool, r *reservation[V], reserved bool) {
+	bkt, key := m.lock(key)
+	defer bkt.Unlock()
+	if value, ok = bkt.m[key]; ok {
+		return
+	}
+	r = bkt.reserved[key]
+	if r == nil {
+		r = &reservation[V]{done: make(chan struct{})}
+		if bkt.reserved == nil {
+			bkt.reserved = make(map[K]*reservation[V])
+		}
+		bkt.reserved[key] = r
+		reserved = true
+	}
+	return
+}
+
+// Fulfill sets the value for a key and wakes up the goroutines
+// waiting for it if the key is reserved.
+func (m *Map[K, V]) Fulfill(key K, value V) {
+	m.fulfill(key, value, true)
+}
+
+// fulfill is Fulfill, but unless overwrite is set, it keeps the value
+// stored for the key meanwhile, if any, and returns it with loaded true,
+// waking up the goroutines waiting for the key with it.
+func (m *Map[K, V]) fulfill(key K, value V, overwrite bool) (actual V, loaded bool) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	actual, loaded = bkt.m[key]
+	if overwrite || !loaded {
+		m.put(bkt, key, value)
+		actual, loaded = value, false
+	}
+	if r := bkt.reserved[key]; r != nil {
+		delete(bkt.reserved, key)
+		r.value, r.ok = actual, true
+		close(r.done)
+	}
+	return
+}
+
+// CancelReservation releases the reservation of a key without setting its value,
+// typically because computing the value failed.
+// The goroutines waiting for the key are woken up and reported not found.
+func (m *Map[K, V]) CancelReservation(key K) {
+	m.failLoad(key, nil)
+}
+
+// failLoad cancels the reservation of a key, reporting err to the
+// goroutines waiting for it in LoadOrStoreErr, if not nil.
+func (m *Map[K, V]) failLoad(key K, err error) {
+	bkt, key := m.lock(key)
+	defer bkt.Unlock()
+	if r := bkt.reserved[key]; r != nil {
+		delete(bkt.reserved, key)
+		r.err = err
+		close(r.done)
+	}
+}
+
+// LoadOrStoreErr returns the existing value for the key if present.
+// Otherwise, it loads a value by load, and stores and returns it
+// if load succeeds, or returns the error of load without storing anything.
+// As in LoadOrCompute, load is called without holding any lock,
+// and concurrent callers for the same key wait for the same load,
+// and get its value or its error, unless the error is caused by
+// ctx of the loading caller being done, in which case another caller loads
+// the value instead.
+// Waiting for the value returns the error of ctx once it is done.
+// If a value is stored for the key while load runs, that value is kept
+// and returned instead of the loaded one.
+func (m *Map[K, V]) LoadOrStoreErr(ctx context.Context, key K, load func(context.Context) (V, error)) (value V, err error) {
+	for {
+		value, ok, r, reserved := m.reserve(key)
+		if ok {
+			return value, nil
+		}
+		if reserved {
+			return m.load(ctx, key, load)
+		}
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return value, ctx.Err()
+		}
+		if r.ok {
+			return r.value, nil
+		}
+		if r.err != nil {
+			return value, r.err
+		}
+		// canceled without an error, try to reserve it again
+	}
+}
+
+// load fulfills the reserved key with the value load returns,
+// unless a value is stored meanwhile, or cancels the reservation if load fails or panics.
+func (m *Map[K, V]) load(ctx context.Context, key K, load func(context.Context) (V, error)) (value V, err error) {
+	done := false
+	defer func() {
+		if !done {
+			m.CancelReservation(key)
+		}
+	}()
+	value, err = load(ctx)
+	done = true
+	if err != nil {
+		if ctx.Err() != nil {
+			m.CancelReservation(key)
+		} else {
+			m.failLoad(key, err)
+		}
+		var zero V
+		return zero, err
+	}
+	value, _ = m.fulfill(key, value, false)
+	return value, nil
+}
+
+// LoadOrCompute returns the existing value for the key if present.
+// Otherwise, it computes a value by compute, and stores and returns it.
+// Unlike LoadOrStoreFunc, compute is called without holding any lock,
+// so a slow compute stalls no other key, and the key is reserved meanwhile,
+// so that concurrent callers for the same key wait for its value
+// instead of computing it again.
+// The loaded result is true if the value was loaded, false if computed.
+// If compute panics, the reservation is canceled, and one of the waiting
+// callers, if any, computes the value instead.
+// If a value is stored for the key while compute runs, that value is kept
+// and returned with loaded true, and the computed one is discarded.
+func (m *Map[K, V]) LoadOrCompute(key K, compute func() V) (actual V, loaded bool) {
+	for {
+		reserved, wait := m.Reserve(key)
+		if !reserved {
+			if value, ok := wait(); ok {
+				return value, true
+			}
+			continue // canceled, try to reserve it again
+		}
+		return m.compute(key, compute)
+	}
+}
+
+// compute fulfills the reserved key with the value compute returns,
+// unless a value is stored meanwhile, or cancels the reservation if compute panics.
+func (m *Map[K, V]) compute(key K, compute func() V) (actual V, loaded bool) {
+	fulfilled := false
+	defer func() {
+		if !fulfilled {
+			m.CancelReservation(key)
+		}
+	}()
+	value := compute()
+	actual, loaded = m.fulfill(key, value, false)
+	fulfilled = true
+	return
+}
+
+// SwapOut atomically replaces the contents of the Map with nothing
+// and returns the previous contents.
+// Unlike draining bucket by bucket, all the buckets are locked at once,
+// so every write happens either before the swap and is returned,
+// or after the swap and stays in the Map.
+func (m *Map[K, V]) SwapOut() map[K]V {
+	olds, n := m.swapOut()
+	if len(olds) == 1 && olds[0] != nil {
+		return olds[0]
+	}
+	snapshot := make(map[K]V, n)
+	for _, old := range olds {
+		for k, v := range old {
+			snapshot[k] = v
+		}
+	}
+	return snapshot
+}
+
+// swapOut swaps the buckets of m for empty ones, and returns their old entries
+// and the number of them.
+func (m *Map[K, V]) swapOut() (olds []map[K]V, n int) {
+	defer m.notifyEmpty()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		t.buckets[i].Lock()
+	}
+	defer func() {
+		for i := 0; i < len(t.buckets); i++ {
+			t.buckets[i].Unlock()
+		}
+	}()
+	// All the deletions are reported before any bucket is swapped,
+	// so that a panicking watcher leaves the Map unchanged.
+	for i := 0; i < len(t.buckets); i++ {
+		reportDeletes(m.watch(), t.buckets[i].m)
+	}
+	olds = make([]map[K]V, len(t.buckets))
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		olds[i] = bkt.m
+		n += len(bkt.m)
+		m.addSize(-len(bkt.m))
+		m.countDeletes(len(bkt.m))
+		bkt.m, bkt.versions = nil, nil
+		m.dropRead(bkt)
+	}
+	return olds, n
+}
+
+// ID returns a token identifying the Map, stable for its lifetime.
+//
+// Code locking buckets of several Maps, possibly along with other locks,
+// should acquire them in a global order to avoid deadlocks:
+// buckets of the Map with the smaller ID first,
+// and buckets of the same Map in ascending index order.
+// Methods of Map never hold more than one bucket lock at a time,
+// unless documented otherwise, in which case they follow the same order.
+func (m *Map[K, V]) ID() uintptr {
+	return uintptr(unsafe.Pointer(m))
+}
+
+// Len returns the number of entries in the Map.
+// The number is kept up to date by every write, so Len takes no locks;
+// with concurrent writes it is a momentary value.
+func (m *Map[K, V]) Len() int {
+	return int(m.size.Load())
+}
+
+// Empty reports whether the Map has no entries. It is the same as Len() == 0.
+func (m *Map[K, V]) Empty() bool {
+	return m.size.Load() == 0
+}
+
+// NumBuckets returns the number of buckets of the Map.
+func (m *Map[K, V]) NumBuckets() int {
+	return len(m.table.Load().buckets)
+}
+
+// RoutingStrategy returns how keys are routed to buckets:
+// "bitmask" if the number of buckets is a power of two, "modulo" otherwise.
+func (m *Map[K, V]) RoutingStrategy() string {
+	if m.table.Load().bitmask {
+		return "bitmask"
+	}
+	return "modulo"
+}
+
+// BucketIndex returns the index of the bucket a key belongs to.
+// The index is valid until the Map is resized.
+func (m *Map[K, V]) BucketIndex(key K) int {
+	return m.table.Load().index(m.normalize(key))
+}
+
+// LockBucket locks the bucket at index for writing,
+// and returns it for accessing its entries directly.
+// Methods of Map accessing the bucket block until UnlockBucket is called,
+// so must not be called for keys of the bucket meanwhile.
+// The Map cannot be resized while any of its buckets is locked.
+// See ID for the lock ordering to follow.
+func (m *Map[K, V]) LockBucket(index int) *LockedBucket[K, V] {
+	for {
+		bkt := &m.table.Load().buckets[index]
+		bkt.Lock()
+		if !bkt.moved {
+			return &LockedBucket[K, V]{m: m, index: index, bkt: bkt}
+		}
+		bkt.Unlock()
+	}
+}
+
+// UnlockBucket unlocks the bucket at index which is locked by LockBucket.
+func (m *Map[K, V]) UnlockBucket(index int) {
+	m.unlock(&m.table.Load().buckets[index])
+}
+
+// LockedBucket is a bucket of a Map locked by LockBucket.
+// It must not be used after the bucket is unlocked.
+// All keys passed to its methods must belong to the bucket,
+// as reported by BucketIndex, or the methods panic.
+type LockedBucket[K comparable, V any] struct {
+	m     *Map[K, V]
+	index int
+	bkt   *bucket[K, V]
+}
+
+// check returns the normalized key, and panics if it does not belong to b.
+func (b *LockedBucket[K, V]) check(key K) K {
+	key = b.m.normalize(key)
+	if b.m.table.Load().index(key) != b.index {
+		panic("bucketmap: key does not belong to the locked bucket")
+	}
+	return key
+}
+
+// Load returns the value stored in the bucket for a key.
+func (b *LockedBucket[K, V]) Load(key K) (value V, ok bool) {
+	key = b.check(key)
+	value, ok = b.bkt.m[key]
+	return
+}
+
+// Store sets the value for a key.
+func (b *LockedBucket[K, V]) Store(key K, value V) {
+	key = b.check(key)
+	b.m.put(b.bkt, key, value)
+}
+
+// Delete deletes the value for a key.
+func (b *LockedBucket[K, V]) Delete(key K) {
+	key = b.check(key)
+	b.m.remove(b.bkt, key)
+}
+
+// Rehash resizes the Map to newBuckets buckets, default 31 if newBuckets <= 0,
+// moving every entry to the bucket its key hashes to in the new table,
+// even if the number of buckets does not change.
+// Operations on the Map block while the entries are being moved.
+// Handles made by Prehash become stale.
+func (m *Map[K, V]) Rehash(newBuckets int) {
+	if newBuckets <= 0 {
+		newBuckets = 31
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resize(newBuckets)
+}
+
+// Compact resizes the Map down to fewer buckets
+// if it holds fewer than a quarter as many entries as buckets, so that less memory is
+// wasted on empty buckets and iterating the Map visits fewer of them.
+// The new number of buckets is the number of entries, but at least minCompactBuckets,
+// so that a Map compacted while nearly empty does not funnel later writes
+// through a handful of locks. A Map with no more buckets than that is left as is.
+// Operations on the Map block while the entries are being moved.
+func (m *Map[K, V]) Compact() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.table.Load()
+	if len(t.buckets) <= minCompactBuckets {
+		return
+	}
+	n := 0
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		n += len(bkt.m)
+		bkt.RUnlock()
+	}
+	if n < len(t.buckets)/4 {
+		m.resize(max(n, minCompactBuckets))
+	}
+}
+
+// minCompactBuckets is the fewest buckets Compact resizes a Map down to.
+const minCompactBuckets = 8
+
+// GetOrCreate returns the existing value for the key if present.
+// Otherwise, it creates a value by create without holding any lock,
+// and stores and returns it.
+// If another goroutine stores a value for the key meanwhile,
+// that value is returned instead, and onReplace, if not nil,
+// is called with the created value so it can be released.
+func (m *Map[K, V]) GetOrCreate(key K, create func() V, onReplace func(old V)) V {
+	if value, ok := m.Load(key); ok {
+		return value
+	}
+	value := create()
+	actual, loaded := m.LoadOrStore(key, value)
+	if loaded && onReplace != nil {
+		onReplace(value)
+	}
+	return actual
+}
+
+// EvictOlderThan deletes the entries whose values are older than age,
+// by the time reported by timeOf, and returns the number of deleted entries.
+// Each bucket is write locked while examining its entries.
+func EvictOlderThan[K comparable, V any](m *Map[K, V], age time.Duration, timeOf func(V) time.Time) int {
+	deadline := time.Now().Add(-age)
+	n := 0
+	defer m.notifyEmpty()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		func() {
+			bkt.Lock()
+			defer bkt.Unlock()
+			for k, v := range bkt.m {
+				var old bool
+				if m.guard(func() { old = timeOf(v).Before(deadline) }) && old {
+					m.remove(bkt, k)
+					n++
+				}
+			}
+		}()
+	}
+	return n
+}
+
+// HasMany reports whether each of the keys is present in the Map,
+// in the same order as keys.
+// The keys are grouped by buckets, so each bucket is locked once.
+func (m *Map[K, V]) HasMany(keys []K) []bool {
+	has := make([]bool, len(keys))
+	keys = m.normalizeAll(keys)
+	t := m.table.Load()
+	for i, group := range t.group(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		if bkt.moved {
+			bkt.RUnlock()
+			for _, j := range group {
+				_, has[j] = m.Load(keys[j])
+			}
+			continue
+		}
+		for _, j := range group {
+			_, has[j] = bkt.m[keys[j]]
+		}
+		bkt.RUnlock()
+	}
+	return has
+}
+
+// LoadMany returns the values for the keys present in the Map,
+// keyed by their normalized forms. Keys not present are left out.
+// The keys are grouped by buckets, so each bucket is locked once.
+func (m *Map[K, V]) LoadMany(keys []K) map[K]V {
+	values := make(map[K]V, len(keys))
+	keys = m.normalizeAll(keys)
+	t := m.table.Load()
+	for i, group := range t.group(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		if bkt.moved {
+			bkt.RUnlock()
+			for _, j := range group {
+				if value, ok := m.Load(keys[j]); ok {
+					values[keys[j]] = value
+				}
+			}
+			continue
+		}
+		for _, j := range group {
+			if value, ok := bkt.m[keys[j]]; ok {
+				values[keys[j]] = value
+			}
+		}
+		bkt.RUnlock()
+	}
+	return values
+}
+
+// StoreMany sets the values for the keys of entries.
+// The keys are grouped by buckets, so each bucket is locked once.
+// If more keys of entries have the same normalized form,
+// which of their values is stored is unspecified.
+func (m *Map[K, V]) StoreMany(entries map[K]V) {
+	keys := make([]K, 0, len(entries))
+	values := make([]V, 0, len(entries))
+	for k, v := range entries {
+		keys = append(keys, m.normalize(k))
+		values = append(values, v)
+	}
+
+	t := m.table.Load()
+	for i, group := range t.group(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		bkt := &t.buckets[i]
+		if !m.withBucket(bkt, func() {
+			for _, j := range group {
+				m.put(bkt, keys[j], values[j])
+			}
+		}) {
+			for _, j := range group {
+				m.Store(keys[j], values[j])
+			}
+		}
+	}
+}
+
+// DeleteMany deletes the values for keys.
+// The keys are grouped by buckets, so each bucket is locked once.
+func (m *Map[K, V]) DeleteMany(keys []K) {
+	keys = m.normalizeAll(keys)
+	t := m.table.Load()
+	for i, group := range t.group(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		bkt := &t.buckets[i]
+		if !m.withBucket(bkt, func() {
+			for _, j := range group {
+				m.remove(bkt, keys[j])
+			}
+		}) {
+			for _, j := range group {
+				m.Delete(keys[j])
+			}
+		}
+	}
+}
+
+// Number is a constraint that permits any integer or floating-point type.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// AddMany adds each of the deltas to the value for its key,
+// taking an absent value as zero.
+// The keys are grouped by buckets, so each bucket is locked once.
+func AddMany[K comparable, V Number](m *Map[K, V], deltas map[K]V) {
+	keys := make([]K, 0, len(deltas))
+	values := make([]V, 0, len(deltas))
+	for k, v := range deltas {
+		keys = append(keys, m.normalize(k))
+		values = append(values, v)
+	}
+
+	add := func(bkt *bucket[K, V], j int) {
+		m.put(bkt, keys[j], bkt.m[keys[j]]+values[j])
+	}
+	t := m.table.Load()
+	for i, group := range t.group(keys) {
+		if len(group) == 0 {
+			continue
+		}
+		bkt := &t.buckets[i]
+		if !m.withBucket(bkt, func() {
+			for _, j := range group {
+				add(bkt, j)
+			}
+		}) {
+			for _, j := range group {
+				func() {
+					bkt, _ := m.lock(keys[j])
+					defer m.unlock(bkt)
+					add(bkt, j)
+				}()
+			}
+		}
+	}
+}
+
+// FoldWhile folds the entries into an accumulator starting with init.
+// For each entry, fn returns the new accumulator and whether to continue;
+// once it reports false, folding stops and that accumulator is returned.
+// fn is called without holding any lock.
+func FoldWhile[K comparable, V, A any](m *Map[K, V], init A, fn func(acc A, k K, v V) (A, bool)) A {
+	acc := init
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		for _, p := range t.buckets[i].pairs() {
+			var ok bool
+			if acc, ok = fn(acc, p.Key, p.Value); !ok {
+				return acc
+			}
+		}
+	}
+	return acc
+}
+
+// TransformInPlace calls fn for each entry and stores the value it returns,
+// or deletes the entry if it reports false.
+// Each bucket is write locked while its entries are transformed,
+// so fn must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) TransformInPlace(fn func(K, V) (V, bool)) {
+	defer m.notifyEmpty()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		func() {
+			bkt.Lock()
+			defer bkt.Unlock()
+			for k, v := range bkt.m {
+				var keep bool
+				if !m.guard(func() { v, keep = fn(k, v) }) {
+					continue
+				}
+				if keep {
+					m.put(bkt, k, v)
+				} else {
+					m.remove(bkt, k)
+				}
+			}
+		}()
+	}
+}
+
+// Apply calls fn with the value for a key, or zero value and loaded false
+// if no value is present, while holding the bucket write lock.
+// If fn reports store true, the new value it returns is stored.
+// Apply returns the result of fn, so that a caller can derive anything
+// from the read-modify-write, such as the value before it.
+// fn must not call back into the Map, or it deadlocks.
+func Apply[K comparable, V, R any](m *Map[K, V], key K, fn func(old V, loaded bool) (new V, store bool, result R)) R {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	old, loaded := bkt.m[key]
+	new, store, result := fn(old, loaded)
+	if store {
+		m.put(bkt, key, new)
+	}
+	return result
+}
+
+// OccupiedBuckets returns the number of buckets holding at least one entry.
+// Compared with NumBuckets, it shows how well keys are distributed.
+func (m *Map[K, V]) OccupiedBuckets() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		if len(bkt.m) > 0 {
+			n++
+		}
+		bkt.RUnlock()
+	}
+	return n
+}
+
+// Claim deletes the value for a key and returns it, if any,
+// handing it over to the caller exclusively.
+// It is the same as LoadAndDelete.
+func (m *Map[K, V]) Claim(key K) (V, bool) {
+	return m.LoadAndDelete(key)
+}
+
+// ClaimAny deletes an arbitrary entry and returns it,
+// handing it over to the caller exclusively,
+// so that a Map can be used as a pool of work items.
+// The ok result reports false if the Map is empty.
+func (m *Map[K, V]) ClaimAny() (key K, value V, ok bool) {
+	t := m.table.Load()
+	start := rand.Intn(len(t.buckets))
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[(start+i)%len(t.buckets)]
+		if !m.withBucket(bkt, func() {
+			for key, value = range bkt.m {
+				m.remove(bkt, key)
+				ok = true
+				return
+			}
+		}) {
+			t = m.table.Load()
+			start = rand.Intn(len(t.buckets))
+			i = -1
+			continue
+		}
+		if ok {
+			return
+		}
+	}
+	return
+}
+
+// LoadCopy returns a copy made by copy of the value stored in the map for a key,
+// so that mutating the returned value does not affect the stored one.
+// copy is called while holding the bucket read lock.
+// The ok result indicates whether value was found in the map.
+func (m *Map[K, V]) LoadCopy(key K, copy func(V) V) (value V, ok bool) {
+	bkt, key := m.rlock(key)
+	defer bkt.RUnlock()
+	if value, ok = bkt.m[key]; ok {
+		value = copy(value)
+	}
+	return
+}
+
+// Rotate stores newValue for a key, whether or not the key is present,
+// and returns the value it replaces, if any, for the caller to recycle,
+// as in double buffering. It is the same as Swap.
+func (m *Map[K, V]) Rotate(key K, newValue V) (old V, hadOld bool) {
+	return m.Swap(key, newValue)
+}
+
+// RotateFunc is like Rotate, but the value to store is computed by next
+// from the value it replaces, while holding the bucket write lock.
+// It returns both the replaced value and the stored one.
+// next must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) RotateFunc(key K, next func(old V, hadOld bool) V) (old, new V, hadOld bool) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	old, hadOld = bkt.m[key]
+	new = next(old, hadOld)
+	m.put(bkt, key, new)
+	return
+}
+
+// MergeCounters adds the values of src into dst key by key,
+// taking an absent value in dst as zero.
+// src is copied bucket by bucket, and each copy is added by AddMany.
+func MergeCounters[K comparable, V Number](dst, src *Map[K, V]) {
+	t := src.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		deltas := maps.Clone(bkt.m)
+		bkt.RUnlock()
+		if len(deltas) > 0 {
+			AddMany(dst, deltas)
+		}
+	}
+}
+
+// StoreIf sets the value for a key only if cond reports true
+// for the current number of entries, and reports whether it is set.
+// The number of entries is read just before setting the value,
+// while holding the bucket write lock, so cond must not call back into the Map.
+// Writes to other buckets may still change the number meanwhile,
+// so cond admits entries approximately, not as a strict limit.
+func (m *Map[K, V]) StoreIf(key K, value V, cond func(currentLen int) bool) bool {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	if !cond(int(m.size.Load())) {
+		return false
+	}
+	m.put(bkt, key, value)
+	return true
+}
+
+// IterKeys returns an iterator over the entries for keys present in the Map.
+// Keys not present are skipped silently.
+// The keys are grouped by buckets, so each bucket is locked once,
+// and the entries are yielded bucket by bucket, not in the order of keys.
+func (m *Map[K, V]) IterKeys(keys []K) func(yield func(K, V) bool) {
+	return func(yield func(K, V) bool) {
+		keys := m.normalizeAll(keys)
+		t := m.table.Load()
+		var pairs []Pair[K, V]
+		for i, group := range t.group(keys) {
+			if len(group) == 0 {
+				continue
+			}
+			pairs = pairs[:0]
+			bkt := &t.buckets[i]
+			bkt.RLock()
+			if bkt.moved {
+				bkt.RUnlock()
+				for _, j := range group {
+					if value, ok := m.Load(keys[j]); ok {
+						pairs = append(pairs, Pair[K, V]{keys[j], value})
+					}
+				}
+			} else {
+				for _, j := range group {
+					if value, ok := bkt.m[keys[j]]; ok {
+						pairs = append(pairs, Pair[K, V]{keys[j], value})
+					}
+				}
+				bkt.RUnlock()
+			}
+			for _, p := range pairs {
+				if !yield(p.Key, p.Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// StoreSized sets the value for a key and returns the change
+// in approximate size, as measured by sizeOf: the size of value
+// minus the size of the value it replaces, if any.
+// sizeOf is called while holding the bucket write lock.
+func (m *Map[K, V]) StoreSized(key K, value V, sizeOf func(V) int) (deltaBytes int) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	deltaBytes = sizeOf(value)
+	if old, ok := bkt.m[key]; ok {
+		deltaBytes -= sizeOf(old)
+	}
+	m.put(bkt, key, value)
+	return
+}
+
+// IterBySizeDesc returns an iterator over key-value pairs in the Map,
+// visiting buckets in descending order of their number of entries,
+// so that the largest buckets are processed first.
+// The sizes are read once, before the iteration starts.
+// The entries of each bucket are copied before any of them is yielded, as in Iter.
+func (m *Map[K, V]) IterBySizeDesc() func(yield func(K, V) bool) {
+	t := m.table.Load()
+	sizes := make([]int, len(t.buckets))
+	order := make([]int, len(t.buckets))
+	for i := range t.buckets {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		sizes[i] = len(bkt.m)
+		bkt.RUnlock()
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]] > sizes[order[j]]
+	})
+
+	return func(yield func(K, V) bool) {
+		for _, i := range order {
+			for _, p := range t.buckets[i].pairs() {
+				if !yield(p.Key, p.Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Accumulate sets the value for a key to the aggregate combine computes
+// from the existing value, or zero value and loaded false if no value is present,
+// while holding the bucket write lock.
+// combine must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) Accumulate(key K, combine func(existing V, loaded bool) V) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	existing, loaded := bkt.m[key]
+	m.put(bkt, key, combine(existing, loaded))
+}
+
+// DeleteAndLen deletes the value for a key, and returns the number of
+// entries left right after the deletion, and whether the key was present.
+// Together they tell whether this deletion emptied the Map.
+func (m *Map[K, V]) DeleteAndLen(key K) (remaining int, deleted bool) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	return m.remove(bkt, key)
+}
+
+// ComputeSafe calls fn with the value for a key, or zero value and loaded false
+// if no value is present, while holding the bucket write lock.
+// If fn reports keep true, the new value it returns is stored,
+// otherwise the entry is deleted.
+// It returns the resulting value if any; the ok result reports whether
+// the key is present afterwards.
+// If fn panics, the entry is left unchanged and a *PanicError is returned.
+// fn must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) ComputeSafe(key K, fn func(old V, loaded bool) (new V, keep bool)) (actual V, ok bool, err error) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	old, loaded := bkt.m[key]
+	new, keep, err := func() (new V, keep bool, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r}
+			}
+		}()
+		new, keep = fn(old, loaded)
+		return
+	}()
+	if err != nil {
+		return old, loaded, err
+	}
+	if keep {
+		m.put(bkt, key, new)
+		return new, true, nil
+	}
+	m.remove(bkt, key)
+	return
+}
+
+// lock2 locks the buckets two keys belong to for writing,
+// in the order of their indexes to avoid deadlocks.
+// It returns the buckets, which are the same one if the keys share it,
+// and the normalized keys.
+func (m *Map[K, V]) lock2(a, b K) (ba, bb *bucket[K, V], na, nb K) {
+	a, b = m.normalize(a), m.normalize(b)
+	for {
+		t := m.table.Load()
+		ba, bb = m.lockIndexes(t, t.index(a), t.index(b))
+		if !ba.moved {
+			return ba, bb, a, b
+		}
+		unlock2(ba, bb)
+	}
+}
+
+// lockIndexes locks the buckets i and j of t for writing,
+// in the order of their indexes, and returns them.
+func (m *Map[K, V]) lockIndexes(t *table[K, V], i, j int) (bi, bj *bucket[K, V]) {
+	bi, bj = &t.buckets[i], &t.buckets[j]
+	if i > j {
+		m.lockBucket(bj)
+	}
+	m.lockBucket(bi)
+	if i < j {
+		m.lockBucket(bj)
+	}
+	return
+}
+
+// unlock2 unlocks the buckets locked by lock2.
+func unlock2[K comparable, V any](ba, bb *bucket[K, V]) {
+	ba.Unlock()
+	if bb != ba {
+		bb.Unlock()
+	}
+}
+
+// SwapKeys atomically exchanges the values for keys a and b.
+// It reports false, changing nothing, if either key is absent.
+// Swapping a key with itself is a no-op reporting true.
+func (m *Map[K, V]) SwapKeys(a, b K) bool {
+	if m.normalize(a) == m.normalize(b) {
+		return true
+	}
+	ba, bb, a, b := m.lock2(a, b)
+	defer unlock2(ba, bb)
+	va, ok := ba.m[a]
+	if !ok {
+		return false
+	}
+	vb, ok := bb.m[b]
+	if !ok {
+		return false
+	}
+	// Both stores are reported before either is made,
+	// so that a panicking watcher leaves both keys unchanged.
+	m.reportStore(ba, a, vb)
+	m.reportStore(bb, b, va)
+	m.set(ba, a, vb)
+	m.set(bb, b, va)
+	return true
+}
+
+// Reposition moves the entry for a key to the bucket its hash selects now,
+// for a Map whose Options.Hash depends on state that may change while the key
+// is stored, such as a field of the value a pointer key points to.
+// Until repositioned, such an entry is out of reach of the methods on single keys,
+// which look for it in the bucket its hash selects now, though Iter and the like
+// still yield it.
+// As its former bucket is unknown, Reposition looks for the entry in every
+// other bucket in turn, locking it along with the bucket the hash selects,
+// in the order of their indexes, as SwapKeys does.
+// It reports whether the entry was moved, false if it is absent or in place.
+// Moving the entry is neither a store nor a deletion: it is not reported
+// to the watcher, keeps the version of the entry, and leaves Len unchanged.
+func (m *Map[K, V]) Reposition(key K) bool {
+	key = m.normalize(key)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	j := t.index(key)
+	for i := range t.buckets {
+		if i != j && m.reposition(t, i, j, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// reposition moves the entry for a key from the bucket i of t to the bucket j,
+// and reports whether the key was in the bucket i and not in the bucket j.
+func (m *Map[K, V]) reposition(t *table[K, V], i, j int, key K) bool {
+	from, to := m.lockIndexes(t, i, j)
+	defer unlock2(from, to)
+	value, ok := from.m[key]
+	if !ok {
+		return false
+	}
+	if _, ok := to.m[key]; ok {
+		return false
+	}
+	m.dropRead(from)
+	m.dropRead(to)
+	delete(from.m, key)
+	if to.m == nil {
+		to.m = make(map[K]V)
+	}
+	to.m[key] = value
+	if version, ok := from.versions[key]; ok {
+		delete(from.versions, key)
+		if to.versions == nil {
+			to.versions = make(map[K]uint64)
+		}
+		to.versions[key] = version
+	}
+	return true
+}
+
+// Handle is a key with the index of its bucket computed by Prehash,
+// so that LoadH and StoreH skip hashing the key.
+type Handle[K comparable, V any] struct {
+	key   K
+	table *table[K, V]
+	index int
+}
+
+// Prehash normalizes and hashes a key once, returning a Handle to access it
+// repeatedly with LoadH and StoreH.
+// The Handle is valid until the Map is resized, as by Compact;
+// a stale Handle still works, but falls back to hashing the key on every access.
+func (m *Map[K, V]) Prehash(key K) Handle[K, V] {
+	key = m.normalize(key)
+	t := m.table.Load()
+	return Handle[K, V]{key: key, table: t, index: t.index(key)}
+}
+
+// LoadH is like Load, but for a key prehashed by Prehash.
+func (m *Map[K, V]) LoadH(h Handle[K, V]) (value V, ok bool) {
+	if h.table == m.table.Load() {
+		bkt := &h.table.buckets[h.index]
+		m.rlockBucket(bkt)
+		if !bkt.moved {
+			value, ok = bkt.m[h.key]
+			bkt.RUnlock()
+			return
+		}
+		bkt.RUnlock()
+	}
+	return m.Load(h.key)
+}
+
+// StoreH is like Store, but for a key prehashed by Prehash.
+func (m *Map[K, V]) StoreH(h Handle[K, V], value V) {
+	if h.table == m.table.Load() {
+		bkt := &h.table.buckets[h.index]
+		m.lockBucket(bkt)
+		if !bkt.moved {
+			defer m.unlock(bkt)
+			m.put(bkt, h.key, value)
+			return
+		}
+		bkt.Unlock()
+	}
+	m.Store(h.key, value)
+}
+
+// Chunks returns a copy of the entries split into n disjoint maps,
+// whose sizes differ by at most one, regardless of the number of buckets.
+// It returns nil if n <= 0.
+// Each bucket is copied at once, but the buckets are copied one by one,
+// so the chunks as a whole may not be a point-in-time snapshot.
+func (m *Map[K, V]) Chunks(n int) []map[K]V {
+	if n <= 0 {
+		return nil
+	}
+	m.mu.RLock()
+	t := m.table.Load()
+	var pairs []Pair[K, V]
+	for i := range t.buckets {
+		pairs = append(pairs, t.buckets[i].pairs()...)
+	}
+	m.mu.RUnlock()
+
+	chunks := make([]map[K]V, n)
+	for i := range chunks {
+		chunks[i] = make(map[K]V, (len(pairs)+n-1-i)/n)
+	}
+	for i, p := range pairs {
+		chunks[i%n][p.Key] = p.Value
+	}
+	return chunks
+}
+
+// DiffCount returns the number of keys present in exactly one of m and other,
+// which may have different numbers of buckets.
+// The keys of each bucket are copied before they are looked up in the other Map,
+// so no two buckets are locked at once;
+// the count is exact only if neither Map is modified meanwhile.
+func (m *Map[K, V]) DiffCount(other *Map[K, V]) int {
+	if m == other {
+		return 0
+	}
+	return m.countMissing(other) + other.countMissing(m)
+}
+
+// countMissing returns the number of keys in m not present in other.
+func (m *Map[K, V]) countMissing(other *Map[K, V]) int {
+	n := 0
+	t := m.table.Load()
+	for i := range t.buckets {
+		for _, p := range t.buckets[i].pairs() {
+			if _, ok := other.Load(p.Key); !ok {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Replace sets the value for a key only if the key is present,
+// and reports whether it is replaced.
+// If so, onOld, if not nil, is called with the replaced value
+// after releasing the bucket lock, so that it may close or recycle it.
+func (m *Map[K, V]) Replace(key K, value V, onOld func(old V)) bool {
+	old, ok := m.replace(key, value)
+	if ok && onOld != nil {
+		onOld(old)
+	}
+	return ok
+}
+
+// replace sets the value for a key only if the key is present,
+// and returns the replaced value if so.
+func (m *Map[K, V]) replace(key K, value V) (old V, ok bool) {
+	bkt, key := m.lock(key)
+	defer bkt.Unlock()
+	old, ok = bkt.m[key]
+	if ok {
+		m.put(bkt, key, value)
+	}
+	return
+}
+
+// CompareAndSwap swaps the old and new values for a key
+// if the value stored in the Map is equal to old.
+// It reports false, storing nothing, if the key is absent.
+func CompareAndSwap[K, V comparable](m *Map[K, V], key K, old, new V) (swapped bool) {
+	bkt, key := m.lock(key)
+	defer bkt.Unlock()
+	if value, ok := bkt.m[key]; ok && value == old {
+		m.put(bkt, key, new)
+		return true
+	}
+	return false
+}
+
+// CompareAndDelete deletes the entry for a key if its value is equal to old.
+// It reports false, changing nothing, if the key is absent or the value differs.
+func CompareAndDelete[K, V comparable](m *Map[K, V], key K, old V) (deleted bool) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	if value, ok := bkt.m[key]; ok && value == old {
+		m.remove(bkt, key)
+		return true
+	}
+	return false
+}
+
+// LoadAndUpdate calls update with the value for a key, or zero value and loaded false
+// if no value is present, while holding the bucket write lock.
+// If update reports keep true, the value it returns is stored,
+// otherwise the entry is deleted, or left absent.
+// It returns the resulting value if any; the ok result reports whether
+// the key is present afterwards.
+// update must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) LoadAndUpdate(key K, update func(old V, loaded bool) (new V, keep bool)) (value V, ok bool) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	old, loaded := bkt.m[key]
+	if value, keep := update(old, loaded); keep {
+		m.put(bkt, key, value)
+		return value, true
+	}
+	m.remove(bkt, key)
+	return
+}
+
+// Version returns the version of the Map, which is increased by every write
+// if the Map is made with TrackVersions, or zero otherwise.
+func (m *Map[K, V]) Version() uint64 {
+	return m.version.Load()
+}
+
+// IterSince returns an iterator over the entries written after version,
+// that is, stamped with a version greater than it.
+// It yields nothing unless the Map is made with TrackVersions.
+//
+// Entries deleted since version are not reported, and an entry written
+// again during the iteration may be yielded with either value, or not at all
+// if its bucket has been copied already; record Version before iterating,
+// and iterate since it next time, to get every write at least once.
+// The entries of each bucket are copied before any of them is yielded, as in Iter.
+func (m *Map[K, V]) IterSince(version uint64) func(yield func(K, V) bool) {
+	t := m.table.Load()
+	order := shuffled(len(t.buckets))
+
+	return func(yield func(K, V) bool) {
+		var pairs []Pair[K, V]
+		for _, i := range order {
+			pairs = pairs[:0]
+			bkt := &t.buckets[i]
+			bkt.RLock()
+			for k, v := range bkt.versions {
+				if v > version {
+					pairs = append(pairs, Pair[K, V]{k, bkt.m[k]})
+				}
+			}
+			bkt.RUnlock()
+			for _, p := range pairs {
+				if !yield(p.Key, p.Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Keys returns the keys in the Map.
+// Each bucket is read at once, but the buckets are read one by one,
+// so with concurrent writes the keys may not be a point-in-time snapshot, as in Iter.
+func (m *Map[K, V]) Keys() []K {
+	keys := make([]K, 0, m.Len())
+	t := m.table.Load()
+	for i := range t.buckets {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		for k := range bkt.m {
+			keys = append(keys, k)
+		}
+		bkt.RUnlock()
+	}
+	return keys
+}
+
+// Values returns the values in the Map.
+// Each bucket is read at once, but the buckets are read one by one,
+// so with concurrent writes the values may not be a point-in-time snapshot, as in Iter.
+func (m *Map[K, V]) Values() []V {
+	values := make([]V, 0, m.Len())
+	t := m.table.Load()
+	for i := range t.buckets {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		for _, v := range bkt.m {
+			values = append(values, v)
+		}
+		bkt.RUnlock()
+	}
+	return values
+}
+
+// DeleteFunc deletes the entries for which pred reports true,
+// and returns the number of entries deleted.
+// Each bucket is write locked while its entries are checked,
+// so there is no window for concurrent writes between checking
+// and deleting an entry, and pred must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) DeleteFunc(pred func(K, V) bool) (deleted int) {
+	defer m.notifyEmpty()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		func() {
+			bkt.Lock()
+			defer bkt.Unlock()
+			for k, v := range bkt.m {
+				var del bool
+				if m.guard(func() { del = pred(k, v) }) && del {
+					m.remove(bkt, k)
+					deleted++
+				}
+			}
+		}()
+	}
+	return
+}
+
+// ReplaceFunc calls fn for each entry, stores the value it returns
+// if it reports true, and returns the number of entries replaced.
+// Unlike TransformInPlace, entries fn reports false for are left unchanged.
+// Each bucket is write locked while its entries are replaced,
+// so fn must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) ReplaceFunc(fn func(K, V) (V, bool)) (replaced int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		bkt := &t.buckets[i]
+		func() {
+			bkt.Lock()
+			defer bkt.Unlock()
+			for k, v := range bkt.m {
+				var replace bool
+				if m.guard(func() { v, replace = fn(k, v) }) && replace {
+					m.put(bkt, k, v)
+					replaced++
+				}
+			}
+		}()
+	}
+	return
+}
+
+// Merge stores the entries of other into m, which may have a different
+// number of buckets. For a key already present in m, the value stored is
+// the one resolve returns from the existing and the incoming values,
+// or the incoming value if resolve is nil.
+// other is copied bucket by bucket, and each entry is stored
+// under the write lock of its bucket in m, so resolve must not call back into m,
+// or it deadlocks. A panic of resolve is handled as RecoverCallbacks of Options
+// describes, the entry it panics on keeping its existing value if recovered.
+func (m *Map[K, V]) Merge(other *Map[K, V], resolve func(key K, dst, src V) V) {
+	t := other.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		for _, p := range t.buckets[i].pairs() {
+			m.merge(p.Key, p.Value, resolve)
+		}
+	}
+}
+
+// merge stores value for a key as Merge does.
+// The bucket is unlocked even if resolve panics.
+func (m *Map[K, V]) merge(key K, value V, resolve func(key K, dst, src V) V) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	if existing, ok := bkt.m[key]; ok && resolve != nil {
+		if !m.guard(func() { value = resolve(key, existing, value) }) {
+			return
+		}
+	}
+	m.put(bkt, key, value)
+}
+
+// Op is the operation Update applies to an entry.
+type Op int
+
+const (
+	// OpKeep leaves the entry unchanged, present or absent.
+	OpKeep Op = iota
+	// OpStore stores the new value.
+	OpStore
+	// OpDelete deletes the entry.
+	OpDelete
+)
+
+// Update calls f with the value for a key, or zero value and loaded false
+// if no value is present, while holding the bucket write lock,
+// and applies the Op it returns: storing the new value it returns,
+// deleting the entry, or leaving it unchanged.
+// It returns the resulting value if any; the ok result reports whether
+// the key is present afterwards.
+// f must not call back into the Map, or it deadlocks.
+func (m *Map[K, V]) Update(key K, f func(old V, loaded bool) (new V, op Op)) (value V, ok bool) {
+	bkt, key := m.lock(key)
+	defer m.unlock(bkt)
+	old, loaded := bkt.m[key]
+	new, op := f(old, loaded)
+	switch op {
+	case OpStore:
+		m.put(bkt, key, new)
+		return new, true
+	case OpDelete:
+		m.remove(bkt, key)
+		return
+	}
+	return old, loaded
+}
+
+// Snapshot returns a copy of the entries in the Map.
+// Each bucket is copied at once, but the buckets are copied one by one,
+// so with concurrent writes the copy may not be a point-in-time snapshot, as in Keys.
+func (m *Map[K, V]) Snapshot() map[K]V {
+	snapshot := make(map[K]V, m.Len())
+	t := m.table.Load()
+	for i := range t.buckets {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		for k, v := range bkt.m {
+			snapshot[k] = v
+		}
+		bkt.RUnlock()
+	}
+	return snapshot
+}
+
+// Range calls f for each key-value pair in the Map, as Iter,
+// until f returns false, like sync.Map.Range.
+func (m *Map[K, V]) Range(f func(key K, value V) bool) {
+	m.Iter()(f)
+}
+
+// IterSorted returns an iterator over key-value pairs in the Map
+// in ascending order of key.
+// The entries are copied bucket by bucket and sorted before any of them
+// is yielded, so the copy costs memory proportional to the size of the Map.
+func IterSorted[K cmp.Ordered, V any](m *Map[K, V]) func(yield func(K, V) bool) {
+	return iterSorted(m, func(K) bool { return true })
+}
+
+// Between returns an iterator over key-value pairs in the Map
+// with keys in [lo, hi), in ascending order of key, as IterSorted.
+// Only the entries in range are copied.
+func Between[K cmp.Ordered, V any](m *Map[K, V], lo, hi K) func(yield func(K, V) bool) {
+	return iterSorted(m, func(k K) bool { return k >= lo && k < hi })
+}
+
+// iterSorted returns an iterator over key-value pairs in the Map
+// with keys for which keep reports true, in ascending order of key.
+func iterSorted[K cmp.Ordered, V any](m *Map[K, V], keep func(K) bool) func(yield func(K, V) bool) {
+	return func(yield func(K, V) bool) {
+		var pairs []Pair[K, V]
+		t := m.table.Load()
+		for i := range t.buckets {
+			bkt := &t.buckets[i]
+			bkt.RLock()
+			for k, v := range bkt.m {
+				if keep(k) {
+					pairs = append(pairs, Pair[K, V]{k, v})
+				}
+			}
+			bkt.RUnlock()
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return cmp.Less(pairs[i].Key, pairs[j].Key)
+		})
+		for _, p := range pairs {
+			if !yield(p.Key, p.Value) {
+				return
+			}
+		}
+	}
+}
+
+// Clone returns a copy of the Map, with the same buckets and options,
+// and a copy of the entries, though the values themselves are copied shallowly.
+// Each bucket is copied at once, but the buckets are copied one by one,
+// so with concurrent writes the copy may not be a point-in-time snapshot.
+// Callbacks registered by OnEmptyChange and Watch, and reservations, are not copied.
+func (m *Map[K, V]) Clone() *Map[K, V] {
+	c := &Map[K, V]{
+		hash:             m.hash,
+		normalizeKey:     m.normalizeKey,
+		measureWait:      m.measureWait,
+		recoverCallbacks: m.recoverCallbacks,
+		trackVersions:    m.trackVersions,
+		readOptimized:    m.readOptimized,
+		countOps:         m.countOps,
+		keyToString:      m.keyToString,
+		keyFromString:    m.keyFromString,
+	}
+	c.version.Store(m.version.Load())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t := m.table.Load()
+	// Sharing the hash keeps every entry in the bucket of the same index.
+	ct := &table[K, V]{
+		buckets: make([]bucket[K, V], len(t.buckets)),
+		hash:    t.hash,
+		mask:    t.mask,
+		bitmask: t.bitmask,
+	}
+	n := 0
+	for i := range t.buckets {
+		bkt, cb := &t.buckets[i], &ct.buckets[i]
+		bkt.RLock()
+		cb.m = maps.Clone(bkt.m)
+		cb.versions = maps.Clone(bkt.versions)
+		bkt.RUnlock()
+		n += len(cb.m)
+	}
+	c.size.Store(int64(n))
+	if n > 0 {
+		c.transitions.Store(1)
 	}
+	c.table.Store(ct)
+	return c
 }
@@ -1,6 +1,17 @@
 package bucketmap
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
 
 func TestMap(t *testing.T) {
 	m := Make[int, string]()
@@ -69,3 +80,2274 @@ func TestMap(t *testing.T) {
 		return true
 	})
 }
+
+func TestBottomN(t *testing.T) {
+	m := Make[string, int]()
+	m.Store("a", 5)
+	m.Store("b", 3)
+	m.Store("c", 9)
+	m.Store("d", 1)
+	m.Store("e", 7)
+	m.Store("f", 2)
+
+	pairs := BottomN(m, 3)
+	want := []Pair[string, int]{{"d", 1}, {"f", 2}, {"b", 3}}
+	if len(pairs) != len(want) {
+		t.Fatalf("bottom 3: %v", pairs)
+	}
+	for i := range want {
+		if pairs[i] != want[i] {
+			t.Fatalf("bottom 3: %v", pairs)
+		}
+	}
+
+	if pairs := BottomN(m, 10); len(pairs) != 6 {
+		t.Fatalf("bottom 10: %v", pairs)
+	}
+	if pairs := BottomN(m, 0); len(pairs) != 0 {
+		t.Fatalf("bottom 0: %v", pairs)
+	}
+}
+
+func TestSwapIf(t *testing.T) {
+	m := Make[int, int]()
+	less := func(n int) func(int) bool {
+		return func(old int) bool { return old < n }
+	}
+
+	if previous, swapped := m.SwapIf(123, less(10), 5); swapped {
+		t.Fatalf("swap absent 123: %v", previous)
+	}
+	if value, ok := m.Load(123); ok {
+		t.Fatalf("load 123: %v", value)
+	}
+
+	m.Store(123, 3)
+	if previous, swapped := m.SwapIf(123, less(10), 5); !swapped {
+		t.Fatalf("swap 123: not swapped")
+	} else if previous != 3 {
+		t.Fatalf("swap 123: %v", previous)
+	}
+
+	if previous, swapped := m.SwapIf(123, less(5), 8); swapped {
+		t.Fatalf("swap 123: swapped")
+	} else if previous != 5 {
+		t.Fatalf("swap 123: %v", previous)
+	}
+	if value, _ := m.Load(123); value != 5 {
+		t.Fatalf("load 123: %v", value)
+	}
+}
+
+func TestDrainTo(t *testing.T) {
+	m := Make[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Store(i, i*i)
+	}
+
+	drained := make(map[int]int)
+	for p := range m.DrainTo(context.Background()) {
+		drained[p.Key] = p.Value
+	}
+	if len(drained) != 100 {
+		t.Fatalf("drained: %v entries", len(drained))
+	}
+	for k, v := range drained {
+		if v != k*k {
+			t.Fatalf("drained %v: %v", k, v)
+		}
+	}
+	m.Iter()(func(key int, value int) bool {
+		t.Fatalf("not drained: %v", key)
+		return false
+	})
+
+	for i := 0; i < 100; i++ {
+		m.Store(i, i*i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := m.DrainTo(ctx)
+	for i := 0; i < 10; i++ {
+		<-ch
+	}
+	cancel()
+	received := 10
+	for range ch {
+		received++
+	}
+	remaining := 0
+	m.Iter()(func(key int, value int) bool {
+		remaining++
+		return true
+	})
+	if received+remaining != 100 {
+		t.Fatalf("drain cancelled: %v received, %v remaining", received, remaining)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	m := Make[int, string]()
+	reserved, wait := m.Reserve(123)
+	if !reserved {
+		t.Fatalf("reserve 123: not reserved")
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 10)
+	for i := range results {
+		again, wait := m.Reserve(123)
+		if again {
+			t.Fatalf("reserve 123 again: reserved")
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, ok := wait()
+			if !ok {
+				value = "not found"
+			}
+			results[i] = value
+		}(i)
+	}
+
+	m.Fulfill(123, "abc")
+	wg.Wait()
+	for i, value := range results {
+		if value != "abc" {
+			t.Fatalf("waiter %v: %v", i, value)
+		}
+	}
+	if value, ok := wait(); !ok || value != "abc" {
+		t.Fatalf("reserver wait: %v, %v", value, ok)
+	}
+
+	if reserved, wait := m.Reserve(123); reserved {
+		t.Fatalf("reserve present 123: reserved")
+	} else if value, ok := wait(); !ok || value != "abc" {
+		t.Fatalf("reserve present 123: %v, %v", value, ok)
+	}
+}
+
+func TestCancelReservation(t *testing.T) {
+	m := Make[int, string]()
+	waitAll := func(key int, cancel bool) []bool {
+		if reserved, _ := m.Reserve(key); !reserved {
+			t.Fatalf("reserve %v: not reserved", key)
+		}
+		var wg sync.WaitGroup
+		found := make([]bool, 5)
+		for i := range found {
+			_, wait := m.Reserve(key)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, found[i] = wait()
+			}(i)
+		}
+		if cancel {
+			m.CancelReservation(key)
+		} else {
+			m.Fulfill(key, "abc")
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("wait %v: blocked", key)
+		}
+		return found
+	}
+
+	for i, ok := range waitAll(123, true) {
+		if ok {
+			t.Fatalf("waiter %v of cancelled 123: found", i)
+		}
+	}
+	if value, ok := m.Load(123); ok {
+		t.Fatalf("load 123: %v", value)
+	}
+	if reserved, _ := m.Reserve(123); !reserved {
+		t.Fatalf("reserve cancelled 123: not reserved")
+	}
+	m.CancelReservation(123)
+
+	for i, ok := range waitAll(456, false) {
+		if !ok {
+			t.Fatalf("waiter %v of fulfilled 456: not found", i)
+		}
+	}
+	if value, ok := m.Load(456); !ok || value != "abc" {
+		t.Fatalf("load 456: %v, %v", value, ok)
+	}
+}
+
+func TestSwapOut(t *testing.T) {
+	m := Make[int, int]()
+	incr := func(key int) {
+		for {
+			value, ok := m.Load(key)
+			if !ok {
+				if _, loaded := m.LoadOrStore(key, 1); !loaded {
+					return
+				}
+				continue
+			}
+			if _, swapped := m.SwapIf(key, func(old int) bool { return old == value }, value+1); swapped {
+				return
+			}
+		}
+	}
+
+	const workers, times = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				incr(j % 10)
+			}
+		}()
+	}
+
+	total := 0
+	for i := 0; i < 10; i++ {
+		for _, n := range m.SwapOut() {
+			total += n
+		}
+	}
+	wg.Wait()
+	for _, n := range m.SwapOut() {
+		total += n
+	}
+	if total != workers*times {
+		t.Fatalf("swap out total: %v", total)
+	}
+}
+
+func TestLockBucket(t *testing.T) {
+	from := Make[string, int]()
+	to := Make[string, int]()
+	from.Store("alice", 100)
+	to.Store("bob", 10)
+
+	// transfer moves n from alice of one Map to bob of the other atomically,
+	// locking the buckets in the documented global order.
+	transfer := func(n int) bool {
+		fi, ti := from.BucketIndex("alice"), to.BucketIndex("bob")
+		var src, dst *LockedBucket[string, int]
+		if from.ID() < to.ID() {
+			src = from.LockBucket(fi)
+			dst = to.LockBucket(ti)
+		} else {
+			dst = to.LockBucket(ti)
+			src = from.LockBucket(fi)
+		}
+		defer from.UnlockBucket(fi)
+		defer to.UnlockBucket(ti)
+
+		balance, _ := src.Load("alice")
+		if balance < n {
+			return false
+		}
+		src.Store("alice", balance-n)
+		credit, _ := dst.Load("bob")
+		dst.Store("bob", credit+n)
+		return true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transfer(10)
+		}()
+	}
+	wg.Wait()
+
+	if balance, _ := from.Load("alice"); balance != 0 {
+		t.Fatalf("load alice: %v", balance)
+	}
+	if credit, _ := to.Load("bob"); credit != 110 {
+		t.Fatalf("load bob: %v", credit)
+	}
+	if transfer(10) {
+		t.Fatalf("transfer: overdrawn")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("store foreign key: not panic")
+			}
+		}()
+		m := Make[int, int](2)
+		key := 0
+		for m.BucketIndex(key) == 0 {
+			key++
+		}
+		b := m.LockBucket(0)
+		defer m.UnlockBucket(0)
+		b.Store(key, 1)
+	}()
+}
+
+func TestCompact(t *testing.T) {
+	m := Make[int, int]()
+	m.Compact()
+	if n := m.NumBuckets(); n != minCompactBuckets {
+		t.Fatalf("compact empty: %v buckets", n)
+	}
+	m = Make[int, int](4)
+	m.Compact()
+	if n := m.NumBuckets(); n != 4 {
+		t.Fatalf("compact empty with few buckets: %v buckets", n)
+	}
+
+	m = Make[int, int]()
+	for i := 0; i < 30; i++ {
+		m.Store(i, i)
+	}
+	m.Compact()
+	if n := m.NumBuckets(); n != 31 {
+		t.Fatalf("compact not sparse: %v buckets", n)
+	}
+
+	m = Make[int, int](128)
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	m.Compact()
+	if n := m.NumBuckets(); n != 128 {
+		t.Fatalf("compact full: %v buckets", n)
+	}
+
+	reserved, wait := m.Reserve(-1)
+	if !reserved {
+		t.Fatalf("reserve -1: not reserved")
+	}
+	for i := 10; i < 1000; i++ {
+		m.Delete(i)
+	}
+	m.Compact()
+	if n := m.NumBuckets(); n != 10 {
+		t.Fatalf("compact sparse: %v buckets", n)
+	}
+	for i := 0; i < 10; i++ {
+		if value, ok := m.Load(i); !ok || value != i {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+	m.Fulfill(-1, -1)
+	if value, ok := wait(); !ok || value != -1 {
+		t.Fatalf("wait -1: %v, %v", value, ok)
+	}
+}
+
+func TestCompactConcurrently(t *testing.T) {
+	m := Make[int, int](64)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := i*1000 + j
+				m.Store(key, key)
+				if value, ok := m.Load(key); !ok || value != key {
+					t.Errorf("load %v: %v, %v", key, value, ok)
+					return
+				}
+				m.Delete(key)
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		m.Compact()
+	}
+	wg.Wait()
+}
+
+func TestGetOrCreate(t *testing.T) {
+	type conn struct {
+		id     int
+		closed atomic.Bool
+	}
+	m := Make[string, *conn]()
+
+	const n = 10
+	var ids atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	results := make([]*conn, n)
+	replaced := make(chan *conn, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results[i] = m.GetOrCreate("db",
+				func() *conn { return &conn{id: int(ids.Add(1))} },
+				func(old *conn) {
+					old.closed.Store(true)
+					replaced <- old
+				})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(replaced)
+
+	cached, ok := m.Load("db")
+	if !ok {
+		t.Fatalf("load db: not exists")
+	}
+	if cached.closed.Load() {
+		t.Fatalf("load db: closed")
+	}
+	for i, c := range results {
+		if c != cached {
+			t.Fatalf("result %v: conn %v, cached %v", i, c.id, cached.id)
+		}
+	}
+	losers := 0
+	for c := range replaced {
+		if c == cached {
+			t.Fatalf("replaced cached conn %v", c.id)
+		}
+		losers++
+	}
+	if created := int(ids.Load()); losers != created-1 {
+		t.Fatalf("created %v conns, replaced %v", created, losers)
+	}
+}
+
+func TestEvictOlderThan(t *testing.T) {
+	now := time.Now()
+	m := Make[string, time.Time]()
+	m.Store("fresh", now)
+	m.Store("recent", now.Add(-30*time.Second))
+	m.Store("old", now.Add(-2*time.Minute))
+	m.Store("ancient", now.Add(-time.Hour))
+
+	if n := EvictOlderThan(m, time.Minute, func(t time.Time) time.Time { return t }); n != 2 {
+		t.Fatalf("evict older than 1m: %v", n)
+	}
+	for _, k := range []string{"fresh", "recent"} {
+		if _, ok := m.Load(k); !ok {
+			t.Fatalf("load %v: not exists", k)
+		}
+	}
+	for _, k := range []string{"old", "ancient"} {
+		if _, ok := m.Load(k); ok {
+			t.Fatalf("load %v: not evicted", k)
+		}
+	}
+}
+
+func TestHasMany(t *testing.T) {
+	m := Make[int, string]()
+	for i := 0; i < 100; i += 3 {
+		m.Store(i, "abc")
+	}
+
+	keys := []int{99, 1, 0, 50, 51, -3, 3, 3}
+	has := m.HasMany(keys)
+	if len(has) != len(keys) {
+		t.Fatalf("has many: %v", has)
+	}
+	for i, key := range keys {
+		if want := key >= 0 && key%3 == 0; has[i] != want {
+			t.Fatalf("has %v: %v", key, has[i])
+		}
+	}
+}
+
+func TestAddMany(t *testing.T) {
+	m := Make[string, int]()
+	m.Store("a", 1)
+	m.Store("b", 2)
+
+	AddMany(m, map[string]int{"a": 10, "b": -2, "c": 5})
+	AddMany(m, map[string]int{"c": 1})
+	for k, want := range map[string]int{"a": 11, "b": 0, "c": 6} {
+		if value, ok := m.Load(k); !ok || value != want {
+			t.Fatalf("load %v: %v, %v", k, value, ok)
+		}
+	}
+}
+
+func TestIterStable(t *testing.T) {
+	m := Make[int, int](1)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+
+	seen := make(map[int]bool)
+	m.IterStable()(func(key int, value int) bool {
+		if key != value {
+			t.Fatalf("iter %v: %v", key, value)
+		}
+		seen[key] = true
+		m.Clear()
+		m.Store(-1, -1)
+		return true
+	})
+	if len(seen) != 100 || seen[-1] {
+		t.Fatalf("iter stable: %v entries", len(seen))
+	}
+
+	n := 0
+	m.IterStable()(func(key int, value int) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("iter break: %v", n)
+	}
+}
+
+func TestFoldWhile(t *testing.T) {
+	m := Make[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Store(i, 10)
+	}
+
+	calls := 0
+	sum := FoldWhile(m, 0, func(acc int, k int, v int) (int, bool) {
+		calls++
+		acc += v
+		return acc, acc < 55
+	})
+	if sum != 60 || calls != 6 {
+		t.Fatalf("fold until 55: %v in %v calls", sum, calls)
+	}
+
+	if sum := FoldWhile(m, 0, func(acc int, k int, v int) (int, bool) {
+		return acc + v, true
+	}); sum != 1000 {
+		t.Fatalf("fold all: %v", sum)
+	}
+}
+
+func TestTransformInPlace(t *testing.T) {
+	m := Make[int, int]()
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+
+	m.TransformInPlace(func(k int, v int) (int, bool) {
+		return v * 2, k%2 == 0
+	})
+	for i := 0; i < 100; i++ {
+		value, ok := m.Load(i)
+		if i%2 != 0 {
+			if ok {
+				t.Fatalf("load %v: %v", i, value)
+			}
+		} else if !ok || value != i*2 {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+}
+
+func TestRoutingStrategy(t *testing.T) {
+	if s := Make[int, int](64).RoutingStrategy(); s != "bitmask" {
+		t.Fatalf("routing of 64 buckets: %v", s)
+	}
+	if s := Make[int, int](31).RoutingStrategy(); s != "modulo" {
+		t.Fatalf("routing of 31 buckets: %v", s)
+	}
+
+	m := Make[int, int](64)
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	for i := 0; i < 1000; i++ {
+		if idx := m.BucketIndex(i); idx < 0 || idx >= 64 {
+			t.Fatalf("bucket index of %v: %v", i, idx)
+		}
+		if value, ok := m.Load(i); !ok || value != i {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	m := Make[string, int]()
+	incr := func(old int, loaded bool) (int, bool, int) {
+		return old + 1, true, old
+	}
+	if old := Apply(m, "a", incr); old != 0 {
+		t.Fatalf("apply a: %v", old)
+	}
+	if old := Apply(m, "a", incr); old != 1 {
+		t.Fatalf("apply a: %v", old)
+	}
+	if value, _ := m.Load("a"); value != 2 {
+		t.Fatalf("load a: %v", value)
+	}
+
+	loaded := Apply(m, "b", func(old int, loaded bool) (int, bool, bool) {
+		return 0, false, loaded
+	})
+	if loaded {
+		t.Fatalf("apply b: loaded")
+	}
+	if value, ok := m.Load("b"); ok {
+		t.Fatalf("load b: %v", value)
+	}
+}
+
+func TestOccupiedBuckets(t *testing.T) {
+	m := Make[int, int](64)
+	if n := m.OccupiedBuckets(); n != 0 {
+		t.Fatalf("occupied buckets of empty: %v", n)
+	}
+
+	buckets := make(map[int]bool)
+	for i := 0; len(buckets) < 3; i++ {
+		m.Store(i, i)
+		buckets[m.BucketIndex(i)] = true
+	}
+	if n := m.OccupiedBuckets(); n != 3 {
+		t.Fatalf("occupied buckets: %v", n)
+	}
+}
+
+func TestFromSlices(t *testing.T) {
+	m, err := FromSlices([]string{"a", "b", "a"}, []int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("from slices: %v", err)
+	}
+	for k, want := range map[string]int{"a": 3, "b": 2} {
+		if value, ok := m.Load(k); !ok || value != want {
+			t.Fatalf("load %v: %v, %v", k, value, ok)
+		}
+	}
+
+	if _, err := FromSlices([]string{"a", "b"}, []int{1}); err == nil {
+		t.Fatalf("from slices of different lengths: no error")
+	}
+}
+
+func TestClaimAny(t *testing.T) {
+	m := Make[int, int]()
+	if _, ok := m.Claim(1); ok {
+		t.Fatalf("claim 1: claimed")
+	}
+	m.Store(1, 1)
+	if value, ok := m.Claim(1); !ok || value != 1 {
+		t.Fatalf("claim 1: %v, %v", value, ok)
+	}
+	if _, _, ok := m.ClaimAny(); ok {
+		t.Fatalf("claim any of empty: claimed")
+	}
+
+	const n = 10000
+	for i := 0; i < n; i++ {
+		m.Store(i, i)
+	}
+	processed := make([]atomic.Int32, n)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				key, value, ok := m.ClaimAny()
+				if !ok {
+					return
+				}
+				if key != value {
+					t.Errorf("claim %v: %v", key, value)
+				}
+				processed[key].Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range processed {
+		if c := processed[i].Load(); c != 1 {
+			t.Fatalf("processed %v: %v times", i, c)
+		}
+	}
+}
+
+func TestLoadCopy(t *testing.T) {
+	m := Make[string, []int]()
+	m.Store("a", []int{1, 2, 3})
+
+	value, ok := m.LoadCopy("a", slices.Clone[[]int])
+	if !ok || !slices.Equal(value, []int{1, 2, 3}) {
+		t.Fatalf("load copy a: %v, %v", value, ok)
+	}
+	value[0] = 100
+	if stored, _ := m.Load("a"); stored[0] != 1 {
+		t.Fatalf("load a: %v", stored)
+	}
+
+	if value, ok := m.LoadCopy("b", slices.Clone[[]int]); ok {
+		t.Fatalf("load copy b: %v", value)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	m := Make[string, []byte]()
+	var pool [][]byte
+	get := func() []byte {
+		if len(pool) == 0 {
+			return make([]byte, 0, 16)
+		}
+		buf := pool[len(pool)-1]
+		pool = pool[:len(pool)-1]
+		return buf[:0]
+	}
+
+	if old, hadOld := m.Rotate("front", append(get(), "frame 1"...)); hadOld {
+		t.Fatalf("rotate front: %q", old)
+	}
+	if old, hadOld := m.Rotate("front", append(get(), "frame 2"...)); !hadOld || string(old) != "frame 1" {
+		t.Fatalf("rotate front: %q, %v", old, hadOld)
+	} else {
+		pool = append(pool, old)
+	}
+
+	old, new, hadOld := m.RotateFunc("front", func(old []byte, hadOld bool) []byte {
+		return append(get(), "frame 3"...)
+	})
+	if !hadOld || string(old) != "frame 2" || string(new) != "frame 3" {
+		t.Fatalf("rotate func front: %q, %q, %v", old, new, hadOld)
+	}
+	if len(pool) != 0 {
+		t.Fatalf("recycled buffer not reused")
+	}
+	if value, _ := m.Load("front"); string(value) != "frame 3" {
+		t.Fatalf("load front: %q", value)
+	}
+
+	_, new, hadOld = m.RotateFunc("back", func(old []byte, hadOld bool) []byte {
+		return append(get(), "frame 1"...)
+	})
+	if hadOld || string(new) != "frame 1" {
+		t.Fatalf("rotate func back: %q, %v", new, hadOld)
+	}
+}
+
+func TestMergeCounters(t *testing.T) {
+	dst := Make[string, int]()
+	src := Make[string, int](7)
+	dst.Store("a", 1)
+	dst.Store("b", 2)
+	src.Store("b", 3)
+	src.Store("c", 4)
+
+	MergeCounters(dst, src)
+	for k, want := range map[string]int{"a": 1, "b": 5, "c": 4} {
+		if value, ok := dst.Load(k); !ok || value != want {
+			t.Fatalf("load %v: %v, %v", k, value, ok)
+		}
+	}
+	if value, _ := src.Load("b"); value != 3 {
+		t.Fatalf("load src b: %v", value)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	m := MakeWithOptions[string, int](Options[string]{
+		NormalizeKey: func(s string) string { return strings.ToLower(strings.TrimSpace(s)) },
+	})
+
+	m.Store("Foo", 1)
+	if value, ok := m.Load(" foo "); !ok || value != 1 {
+		t.Fatalf("load foo: %v, %v", value, ok)
+	}
+	if previous, loaded := m.Swap("FOO", 2); !loaded || previous != 1 {
+		t.Fatalf("swap FOO: %v, %v", previous, loaded)
+	}
+	if has := m.HasMany([]string{"fOO", "bar"}); !has[0] || has[1] {
+		t.Fatalf("has many: %v", has)
+	}
+	AddMany(m, map[string]int{"foo": 1, "Foo": 1})
+
+	keys := 0
+	m.Iter()(func(key string, value int) bool {
+		if key != "foo" || value != 4 {
+			t.Fatalf("iter %q: %v", key, value)
+		}
+		keys++
+		return true
+	})
+	if keys != 1 {
+		t.Fatalf("iter: %v keys", keys)
+	}
+
+	m.Delete(" FOO")
+	if value, ok := m.Load("foo"); ok {
+		t.Fatalf("load foo: %v", value)
+	}
+}
+
+func TestWaitStats(t *testing.T) {
+	m := MakeWithOptions[int, int](Options[int]{MeasureWait: true})
+	m.Store(1, 1)
+	if total, max := m.WaitStats(); total != 0 || max != 0 {
+		t.Fatalf("wait stats uncontended: %v, %v", total, max)
+	}
+
+	idx := m.BucketIndex(1)
+	m.LockBucket(idx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Store(1, 2)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	m.UnlockBucket(idx)
+	<-done
+
+	total, max := m.WaitStats()
+	if max < 10*time.Millisecond || total < max {
+		t.Fatalf("wait stats contended: %v, %v", total, max)
+	}
+
+	plain := Make[int, int]()
+	plain.LockBucket(0)
+	plain.UnlockBucket(0)
+	if total, max := plain.WaitStats(); total != 0 || max != 0 {
+		t.Fatalf("wait stats unmeasured: %v, %v", total, max)
+	}
+}
+
+func TestStoreIf(t *testing.T) {
+	m := Make[int, int]()
+	under := func(n int) func(int) bool {
+		return func(currentLen int) bool { return currentLen < n }
+	}
+	for i := 0; i < 10; i++ {
+		if stored := m.StoreIf(i, i, under(5)); stored != (i < 5) {
+			t.Fatalf("store if %v: %v", i, stored)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := m.Load(i); ok != (i < 5) {
+			t.Fatalf("load %v: %v", i, ok)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	m := Make[int, int]()
+	count := func() int64 {
+		var n int64
+		m.Iter()(func(int, int) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	check := func(op string) {
+		t.Helper()
+		if n, want := m.size.Load(), count(); n != want {
+			t.Fatalf("size after %v: %v, want %v", op, n, want)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	m.Store(0, 0)
+	check("store")
+	m.Delete(0)
+	m.Delete(0)
+	check("delete")
+	m.LoadAndDelete(1)
+	m.LoadOrStore(1, 1)
+	m.LoadOrStore(1, 1)
+	m.LoadOrStoreFunc(100, func() int { return 100 })
+	m.Swap(101, 101)
+	check("load or store")
+	AddMany(m, map[int]int{1: 1, 200: 1})
+	Apply(m, 201, func(int, bool) (int, bool, int) { return 0, true, 0 })
+	m.RotateFunc(202, func(int, bool) int { return 0 })
+	m.Fulfill(203, 0)
+	check("add")
+	EvictOlderThan(m, 0, func(v int) time.Time {
+		return time.Now().Add(time.Duration(v%2) * time.Hour)
+	})
+	check("evict")
+	m.TransformInPlace(func(k, v int) (int, bool) { return v, k%3 != 0 })
+	m.ClaimAny()
+	check("transform")
+	m.Compact()
+	check("compact")
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := m.DrainTo(ctx)
+	<-ch
+	cancel()
+	for range ch {
+	}
+	check("drain")
+	m.Store(1, 1)
+	m.SwapOut()
+	check("swap out")
+	m.Store(1, 1)
+	m.Clear()
+	check("clear")
+}
+
+func TestIterKeys(t *testing.T) {
+	m := Make[int, int]()
+	for i := 0; i < 100; i += 2 {
+		m.Store(i, i*10)
+	}
+
+	got := make(map[int]int)
+	m.IterKeys([]int{0, 1, 2, 3, 50, 99, 98})(func(key int, value int) bool {
+		got[key] = value
+		return true
+	})
+	if len(got) != 4 || got[0] != 0 || got[2] != 20 || got[50] != 500 || got[98] != 980 {
+		t.Fatalf("iter keys: %v", got)
+	}
+
+	n := 0
+	m.IterKeys([]int{0, 2, 4, 6})(func(int, int) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Fatalf("iter keys break: %v", n)
+	}
+}
+
+func TestStoreSized(t *testing.T) {
+	m := Make[string, []byte]()
+	sizeOf := func(b []byte) int { return len(b) }
+
+	if delta := m.StoreSized("a", make([]byte, 100), sizeOf); delta != 100 {
+		t.Fatalf("store sized a: %v", delta)
+	}
+	if delta := m.StoreSized("a", make([]byte, 30), sizeOf); delta != -70 {
+		t.Fatalf("store sized a: %v", delta)
+	}
+	if delta := m.StoreSized("a", make([]byte, 50), sizeOf); delta != 20 {
+		t.Fatalf("store sized a: %v", delta)
+	}
+	if value, _ := m.Load("a"); len(value) != 50 {
+		t.Fatalf("load a: %v bytes", len(value))
+	}
+}
+
+func TestIterBySizeDesc(t *testing.T) {
+	m := Make[int, int](4)
+	sizes := make([]int, 4)
+	for i := 0; sizes[0] < 1 || sizes[1] < 4 || sizes[2] < 2 || sizes[3] < 3; i++ {
+		idx := m.BucketIndex(i)
+		if sizes[idx] < []int{1, 4, 2, 3}[idx] {
+			m.Store(i, i)
+			sizes[idx]++
+		}
+	}
+
+	var visited []int
+	m.IterBySizeDesc()(func(key int, value int) bool {
+		idx := m.BucketIndex(key)
+		if len(visited) == 0 || visited[len(visited)-1] != idx {
+			visited = append(visited, idx)
+		}
+		return true
+	})
+	if !slices.Equal(visited, []int{1, 3, 2, 0}) {
+		t.Fatalf("visited buckets: %v", visited)
+	}
+}
+
+func TestAccumulate(t *testing.T) {
+	type stats struct {
+		count    int
+		sum      int
+		min, max int
+	}
+	m := Make[string, stats]()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 1; j <= 100; j++ {
+				sample := i*100 + j
+				m.Accumulate([]string{"even", "odd"}[sample%2], func(s stats, loaded bool) stats {
+					if !loaded {
+						return stats{1, sample, sample, sample}
+					}
+					return stats{s.count + 1, s.sum + sample, min(s.min, sample), max(s.max, sample)}
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if s, _ := m.Load("even"); s != (stats{400, 400 * 401, 2, 800}) {
+		t.Fatalf("even stats: %+v", s)
+	}
+	if s, _ := m.Load("odd"); s != (stats{400, 400 * 400, 1, 799}) {
+		t.Fatalf("odd stats: %+v", s)
+	}
+}
+
+func TestDeleteAndLen(t *testing.T) {
+	m := Make[int, int]()
+	for i := 0; i < 3; i++ {
+		m.Store(i, i)
+	}
+
+	for i := 0; i < 3; i++ {
+		if remaining, deleted := m.DeleteAndLen(i); !deleted || remaining != 2-i {
+			t.Fatalf("delete %v: %v, %v", i, remaining, deleted)
+		}
+	}
+	if remaining, deleted := m.DeleteAndLen(0); deleted || remaining != 0 {
+		t.Fatalf("delete absent 0: %v, %v", remaining, deleted)
+	}
+}
+
+func TestRecoverCallbacks(t *testing.T) {
+	m := Make[int, int]()
+	m.Store(1, 1)
+
+	_, _, err := m.ComputeSafe(1, func(old int, loaded bool) (int, bool) {
+		panic("boom")
+	})
+	var pe *PanicError
+	if !errors.As(err, &pe) || pe.Value != "boom" {
+		t.Fatalf("compute safe panic: %v", err)
+	}
+	if value, ok, err := m.ComputeSafe(1, func(old int, loaded bool) (int, bool) {
+		return old + 1, true
+	}); err != nil || !ok || value != 2 {
+		t.Fatalf("compute safe 1: %v, %v, %v", value, ok, err)
+	}
+	if _, ok, err := m.ComputeSafe(1, func(int, bool) (int, bool) { return 0, false }); err != nil || ok {
+		t.Fatalf("compute safe delete 1: %v, %v", ok, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		m.Store(i, i)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("transform panic: not propagated")
+			}
+		}()
+		m.TransformInPlace(func(k, v int) (int, bool) { panic("boom") })
+	}()
+	m.Store(10, 10)
+	if value, ok := m.Load(10); !ok || value != 10 {
+		t.Fatalf("load 10 after panic: %v, %v", value, ok)
+	}
+
+	r := MakeWithOptions[int, int](Options[int]{RecoverCallbacks: true})
+	for i := 0; i < 10; i++ {
+		r.Store(i, i)
+	}
+	r.TransformInPlace(func(k, v int) (int, bool) {
+		if k == 3 {
+			panic("boom")
+		}
+		return v * 10, true
+	})
+	for i := 0; i < 10; i++ {
+		want := i * 10
+		if i == 3 {
+			want = 3
+		}
+		if value, _ := r.Load(i); value != want {
+			t.Fatalf("load %v: %v", i, value)
+		}
+	}
+	if n := EvictOlderThan(r, 0, func(v int) time.Time {
+		if v == 3 {
+			panic("boom")
+		}
+		return time.Time{}
+	}); n != 9 {
+		t.Fatalf("evict with panic: %v", n)
+	}
+}
+
+func TestMergePanic(t *testing.T) {
+	dst := Make[int, int](4)
+	src := Make[int, int](4)
+	for i := 0; i < 10; i++ {
+		dst.Store(i, i)
+		src.Store(i, i*10)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("merge panic: not propagated")
+			}
+		}()
+		dst.Merge(src, func(key, a, b int) int { panic("boom") })
+	}()
+	for i := 0; i < 10; i++ {
+		dst.Store(i, i) // would deadlock if a bucket were left locked
+	}
+
+	r := MakeWithOptions[int, int](Options[int]{RecoverCallbacks: true})
+	for i := 0; i < 10; i++ {
+		r.Store(i, i)
+	}
+	r.Merge(src, func(key, a, b int) int {
+		if key == 3 {
+			panic("boom")
+		}
+		return b
+	})
+	for i := 0; i < 10; i++ {
+		want := i * 10
+		if i == 3 {
+			want = 3
+		}
+		if value, _ := r.Load(i); value != want {
+			t.Fatalf("load %v after merge: %v", i, value)
+		}
+	}
+}
+
+func TestSwapKeys(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i*10)
+	}
+	a, b := 0, 1
+	for m.BucketIndex(a) == m.BucketIndex(b) {
+		b++
+	}
+	if !m.SwapKeys(a, b) {
+		t.Fatalf("swap keys %v, %v: false", a, b)
+	}
+	if va, _ := m.Load(a); va != b*10 {
+		t.Fatalf("load %v after swap: %v", a, va)
+	}
+	if vb, _ := m.Load(b); vb != a*10 {
+		t.Fatalf("load %v after swap: %v", b, vb)
+	}
+
+	if m.SwapKeys(a, 1000) {
+		t.Fatalf("swap keys with absent key: true")
+	}
+	if va, _ := m.Load(a); va != b*10 {
+		t.Fatalf("load %v after failed swap: %v", a, va)
+	}
+	if !m.SwapKeys(a, a) {
+		t.Fatalf("swap key with itself: false")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.SwapKeys((i+j)%100, (i*7+j*3)%100)
+			}
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[int]bool)
+	m.Iter()(func(k, v int) bool {
+		seen[v] = true
+		return true
+	})
+	if len(seen) != 100 {
+		t.Fatalf("distinct values after concurrent swaps: %v", len(seen))
+	}
+}
+
+func TestLoadOrInsert(t *testing.T) {
+	m := Make[string, int]()
+	if actual, inserted := m.LoadOrInsert("a", 1); !inserted || actual != 1 {
+		t.Fatalf("load or insert a: %v, %v", actual, inserted)
+	}
+	if actual, inserted := m.LoadOrInsert("a", 2); inserted || actual != 1 {
+		t.Fatalf("load or insert a again: %v, %v", actual, inserted)
+	}
+	if value, _ := m.Load("a"); value != 1 {
+		t.Fatalf("load a: %v", value)
+	}
+}
+
+func TestPrehash(t *testing.T) {
+	m := Make[string, int](8)
+	h := m.Prehash("a")
+	m.StoreH(h, 1)
+	if value, ok := m.Load("a"); !ok || value != 1 {
+		t.Fatalf("load a: %v, %v", value, ok)
+	}
+	if value, ok := m.LoadH(h); !ok || value != 1 {
+		t.Fatalf("load handle a: %v, %v", value, ok)
+	}
+
+	m.Store("b", 2)
+	m.Compact()
+	m.StoreH(h, 3)
+	if value, ok := m.LoadH(h); !ok || value != 3 {
+		t.Fatalf("load stale handle a: %v, %v", value, ok)
+	}
+	if value, ok := m.Load("a"); !ok || value != 3 {
+		t.Fatalf("load a after compact: %v, %v", value, ok)
+	}
+}
+
+func BenchmarkLoad(b *testing.B) {
+	m := Make[string, int]()
+	m.Store("key", 1)
+	for i := 0; i < b.N; i++ {
+		m.Load("key")
+	}
+}
+
+func BenchmarkLoadH(b *testing.B) {
+	m := Make[string, int]()
+	m.Store("key", 1)
+	h := m.Prehash("key")
+	for i := 0; i < b.N; i++ {
+		m.LoadH(h)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 103; i++ {
+		m.Store(i, i*10)
+	}
+	if chunks := m.Chunks(0); chunks != nil {
+		t.Fatalf("chunks 0: %v", chunks)
+	}
+
+	chunks := m.Chunks(10)
+	if len(chunks) != 10 {
+		t.Fatalf("chunks: %v", len(chunks))
+	}
+	union := make(map[int]int)
+	for i, chunk := range chunks {
+		if len(chunk) < 10 || len(chunk) > 11 {
+			t.Fatalf("chunk %v size: %v", i, len(chunk))
+		}
+		for k, v := range chunk {
+			if _, ok := union[k]; ok {
+				t.Fatalf("key %v in more than one chunk", k)
+			}
+			union[k] = v
+		}
+	}
+	if len(union) != 103 {
+		t.Fatalf("union size: %v", len(union))
+	}
+	for k, v := range union {
+		if v != k*10 {
+			t.Fatalf("union %v: %v", k, v)
+		}
+	}
+}
+
+func TestDiffCount(t *testing.T) {
+	a := Make[int, int](4)
+	b := Make[int, int](7)
+	for i := 0; i < 100; i++ {
+		a.Store(i, i)
+	}
+	for i := 90; i < 120; i++ {
+		b.Store(i, -i)
+	}
+	if n := a.DiffCount(b); n != 110 {
+		t.Fatalf("diff count a, b: %v", n)
+	}
+	if n := b.DiffCount(a); n != 110 {
+		t.Fatalf("diff count b, a: %v", n)
+	}
+	if n := a.DiffCount(a); n != 0 {
+		t.Fatalf("diff count a, a: %v", n)
+	}
+	if n := a.DiffCount(Make[int, int]()); n != 100 {
+		t.Fatalf("diff count a, empty: %v", n)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	m := Make[string, int]()
+	called := false
+	if m.Replace("a", 1, func(int) { called = true }) {
+		t.Fatalf("replace absent a: true")
+	}
+	if called {
+		t.Fatalf("replace absent a: onOld called")
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatalf("replace absent a: stored")
+	}
+
+	m.Store("a", 1)
+	var old int
+	if !m.Replace("a", 2, func(v int) {
+		old = v
+		m.Store("b", v) // the bucket lock is released
+	}) {
+		t.Fatalf("replace a: false")
+	}
+	if old != 1 {
+		t.Fatalf("replace a: old %v", old)
+	}
+	if value, _ := m.Load("a"); value != 2 {
+		t.Fatalf("load a: %v", value)
+	}
+}
+
+func TestLen(t *testing.T) {
+	m := Make[int, int](64)
+	if n := m.Len(); n != 0 || !m.Empty() {
+		t.Fatalf("len of new map: %v, %v", n, m.Empty())
+	}
+	for i := 0; i < 10; i++ {
+		m.Store(i, i)
+	}
+	m.Store(0, 1)
+	if n := m.Len(); n != 10 || m.Empty() {
+		t.Fatalf("len: %v, %v", n, m.Empty())
+	}
+	for i := 0; i < 10; i++ {
+		m.Delete(i)
+	}
+	if n := m.Len(); n != 0 || !m.Empty() {
+		t.Fatalf("len after delete: %v, %v", n, m.Empty())
+	}
+}
+
+func TestOnEmptyChange(t *testing.T) {
+	m := Make[int, int]()
+	var calls []bool
+	m.OnEmptyChange(func(empty bool) {
+		m.Load(0) // the bucket locks are released
+		calls = append(calls, empty)
+	})
+	check := func(op string, want ...bool) {
+		t.Helper()
+		if !slices.Equal(calls, want) {
+			t.Fatalf("calls after %v: %v, want %v", op, calls, want)
+		}
+	}
+
+	m.Store(1, 1)
+	m.Store(2, 2)
+	check("store", false)
+	m.Delete(1)
+	m.Delete(3)
+	check("delete 1", false)
+	m.Delete(2)
+	check("delete 2", false, true)
+	m.LoadOrStore(1, 1)
+	check("load or store", false, true, false)
+	m.Store(2, 2)
+	m.Clear()
+	check("clear", false, true, false, true)
+	AddMany(m, map[int]int{1: 1, 2: 2})
+	m.TransformInPlace(func(k, v int) (int, bool) { return v, false })
+	check("transform", false, true, false, true, false, true)
+
+	var mu sync.Mutex
+	var last []bool
+	c := Make[int, int]()
+	c.OnEmptyChange(func(empty bool) {
+		mu.Lock()
+		last = append(last, empty)
+		mu.Unlock()
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Store(i, j)
+				c.Delete(i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := c.transitions.Load(); len(last) == 0 || uint64(len(last)) != n || n%2 != 0 {
+		t.Fatalf("concurrent calls: %v for %v transitions", len(last), n)
+	}
+	for i, empty := range last {
+		if empty != (i%2 == 1) {
+			t.Fatalf("concurrent call %v: %v", i, empty)
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	m := Make[string, int]()
+	if CompareAndSwap(m, "a", 0, 1) {
+		t.Fatalf("compare and swap absent a: true")
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatalf("compare and swap absent a: stored")
+	}
+	m.Store("a", 1)
+	if CompareAndSwap(m, "a", 2, 3) {
+		t.Fatalf("compare and swap a mismatch: true")
+	}
+	if !CompareAndSwap(m, "a", 1, 2) {
+		t.Fatalf("compare and swap a: false")
+	}
+	if value, _ := m.Load("a"); value != 2 {
+		t.Fatalf("load a: %v", value)
+	}
+
+	if CompareAndDelete(m, "b", 0) {
+		t.Fatalf("compare and delete absent b: true")
+	}
+	if CompareAndDelete(m, "a", 1) {
+		t.Fatalf("compare and delete a mismatch: true")
+	}
+	if value, ok := m.Load("a"); !ok || value != 2 {
+		t.Fatalf("load a after mismatch: %v, %v", value, ok)
+	}
+	if !CompareAndDelete(m, "a", 2) {
+		t.Fatalf("compare and delete a: false")
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatalf("load a after compare and delete: ok")
+	}
+}
+
+func TestLoadAndUpdate(t *testing.T) {
+	m := Make[string, int]()
+	incr := func(old int, loaded bool) (int, bool) { return old + 1, true }
+	if value, ok := m.LoadAndUpdate("a", incr); !ok || value != 1 {
+		t.Fatalf("update absent a: %v, %v", value, ok)
+	}
+	if value, ok := m.LoadAndUpdate("a", incr); !ok || value != 2 {
+		t.Fatalf("update a: %v, %v", value, ok)
+	}
+	if value, ok := m.LoadAndUpdate("a", func(int, bool) (int, bool) { return 0, false }); ok || value != 0 {
+		t.Fatalf("update delete a: %v, %v", value, ok)
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatalf("load a after delete: ok")
+	}
+	if _, ok := m.LoadAndUpdate("b", func(int, bool) (int, bool) { return 1, false }); ok {
+		t.Fatalf("update absent b left absent: ok")
+	}
+	if n := m.Len(); n != 0 {
+		t.Fatalf("len: %v", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.LoadAndUpdate("c", incr)
+			}
+		}()
+	}
+	wg.Wait()
+	if value, _ := m.Load("c"); value != 8000 {
+		t.Fatalf("concurrent updates: %v", value)
+	}
+}
+
+func TestIterSince(t *testing.T) {
+	m := MakeWithOptions[int, int](Options[int]{Buckets: 4, TrackVersions: true})
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	base := m.Version()
+	if base != 100 {
+		t.Fatalf("version: %v", base)
+	}
+
+	m.Store(1, 10)
+	m.Store(200, 200)
+	m.Delete(2)
+	m.SwapIf(3, func(int) bool { return true }, 30)
+	m.Compact()
+
+	got := make(map[int]int)
+	m.IterSince(base)(func(k, v int) bool {
+		got[k] = v
+		return true
+	})
+	if want := map[int]int{1: 10, 200: 200, 3: 30}; !maps.Equal(got, want) {
+		t.Fatalf("iter since %v: %v, want %v", base, got, want)
+	}
+
+	base = m.Version()
+	m.Store(7, 70)
+	got = make(map[int]int)
+	m.IterSince(base)(func(k, v int) bool {
+		got[k] = v
+		return true
+	})
+	if len(got) != 1 || got[7] != 70 {
+		t.Fatalf("iter since %v: %v", base, got)
+	}
+
+	u := Make[int, int]()
+	u.Store(1, 1)
+	u.IterSince(0)(func(k, v int) bool {
+		t.Fatalf("iter since untracked map: yields %v", k)
+		return true
+	})
+}
+
+func TestKeysValues(t *testing.T) {
+	m := Make[int, int](4)
+	if keys, values := m.Keys(), m.Values(); len(keys) != 0 || len(values) != 0 {
+		t.Fatalf("keys and values of empty map: %v, %v", keys, values)
+	}
+	for i := 0; i < 100; i++ {
+		m.Store(i, i*10)
+	}
+	keys, values := m.Keys(), m.Values()
+	slices.Sort(keys)
+	slices.Sort(values)
+	if len(keys) != 100 || len(values) != 100 {
+		t.Fatalf("keys and values: %v, %v", len(keys), len(values))
+	}
+	for i := range keys {
+		if keys[i] != i || values[i] != i*10 {
+			t.Fatalf("keys and values %v: %v, %v", i, keys[i], values[i])
+		}
+	}
+}
+
+func TestMakeWithHash(t *testing.T) {
+	type key struct {
+		id   uint64
+		name string
+	}
+	m := MakeWithHash[key, int](8, func(k key) uint64 { return k.id })
+	for i := 0; i < 100; i++ {
+		m.Store(key{uint64(i), strings.Repeat("x", i)}, i)
+	}
+	for i := 0; i < 100; i++ {
+		k := key{uint64(i), strings.Repeat("x", i)}
+		if index := m.BucketIndex(k); index != i%8 {
+			t.Fatalf("bucket index of %v: %v", i, index)
+		}
+		if value, ok := m.Load(k); !ok || value != i {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+	m.Compact()
+	if value, ok := m.Load(key{7, strings.Repeat("x", 7)}); !ok || value != 7 {
+		t.Fatalf("load 7 after compact: %v, %v", value, ok)
+	}
+
+	d := MakeWithHash[string, int](0, nil)
+	d.Store("a", 1)
+	if value, ok := d.Load("a"); !ok || value != 1 || d.NumBuckets() != 31 {
+		t.Fatalf("default hash: %v, %v, %v", value, ok, d.NumBuckets())
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	if n := m.DeleteFunc(func(k, v int) bool { return v%2 == 0 }); n != 50 {
+		t.Fatalf("deleted: %v", n)
+	}
+	if n := m.Len(); n != 50 {
+		t.Fatalf("len after delete func: %v", n)
+	}
+	m.Iter()(func(k, v int) bool {
+		if v%2 == 0 {
+			t.Fatalf("even %v not deleted", k)
+		}
+		return true
+	})
+	m.DeleteFunc(func(int, int) bool { return true })
+	if !m.Empty() {
+		t.Fatalf("delete all: %v left", m.Len())
+	}
+}
+
+func TestReplaceFunc(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	n := m.ReplaceFunc(func(k, v int) (int, bool) { return -v, v%3 == 0 })
+	if n != 34 {
+		t.Fatalf("replaced: %v", n)
+	}
+	m.Iter()(func(k, v int) bool {
+		want := k
+		if k%3 == 0 {
+			want = -k
+		}
+		if v != want {
+			t.Fatalf("value of %v: %v", k, v)
+		}
+		return true
+	})
+	if n := m.Len(); n != 100 {
+		t.Fatalf("len after replace func: %v", n)
+	}
+}
+
+func TestRehash(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	m.Rehash(128)
+	if n := m.NumBuckets(); n != 128 {
+		t.Fatalf("buckets after rehash: %v", n)
+	}
+	if n := m.Len(); n != 1000 {
+		t.Fatalf("len after rehash: %v", n)
+	}
+	for i := 0; i < 1000; i++ {
+		if value, ok := m.Load(i); !ok || value != i {
+			t.Fatalf("load %v after rehash: %v, %v", i, value, ok)
+		}
+	}
+	m.Rehash(0)
+	if n := m.NumBuckets(); n != 31 {
+		t.Fatalf("buckets after rehash 0: %v", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := 1000 + i*1000 + j
+				m.Store(key, key)
+				if value, ok := m.Load(key); !ok || value != key {
+					t.Errorf("load %v: %v, %v", key, value, ok)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		m.Rehash(1 + i*7)
+	}
+	wg.Wait()
+	if n := m.Len(); n != 5000 {
+		t.Fatalf("len after concurrent rehash: %v", n)
+	}
+}
+
+func TestStoreMany(t *testing.T) {
+	m := Make[int, int](4)
+	entries := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		entries[i] = i * 10
+	}
+	m.Store(0, -1)
+	m.StoreMany(entries)
+	if n := m.Len(); n != 100 {
+		t.Fatalf("len after store many: %v", n)
+	}
+	for i := 0; i < 100; i++ {
+		if value, ok := m.Load(i); !ok || value != i*10 {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+
+	values := m.LoadMany([]int{1, 2, 3, 200, 2})
+	if want := map[int]int{1: 10, 2: 20, 3: 30}; !maps.Equal(values, want) {
+		t.Fatalf("load many: %v, want %v", values, want)
+	}
+	if values := m.LoadMany(nil); len(values) != 0 {
+		t.Fatalf("load many nil: %v", values)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dst := Make[int, int](4)
+	src := Make[int, int](7)
+	for i := 0; i < 10; i++ {
+		dst.Store(i, i)
+	}
+	for i := 5; i < 15; i++ {
+		src.Store(i, i*100)
+	}
+
+	var resolved []int
+	dst.Merge(src, func(key, d, s int) int {
+		resolved = append(resolved, key)
+		return d + s
+	})
+	slices.Sort(resolved)
+	if !slices.Equal(resolved, []int{5, 6, 7, 8, 9}) {
+		t.Fatalf("resolved keys: %v", resolved)
+	}
+	for i := 0; i < 15; i++ {
+		want := i
+		switch {
+		case i >= 10:
+			want = i * 100
+		case i >= 5:
+			want = i + i*100
+		}
+		if value, ok := dst.Load(i); !ok || value != want {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+
+	src.Store(0, -1)
+	dst.Merge(src, nil)
+	if value, _ := dst.Load(0); value != -1 {
+		t.Fatalf("merge without resolve: %v", value)
+	}
+	if n := dst.Len(); n != 15 {
+		t.Fatalf("len: %v", n)
+	}
+}
+
+func TestIterConcurrently(t *testing.T) {
+	m := Make[int, int](8)
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := 1000 + (i*1000+j)%4000
+				m.Store(key, key)
+				m.Delete(key)
+			}
+		}(i)
+	}
+	for n := 0; n < 20; n++ {
+		seen := make(map[int]bool)
+		m.Iter()(func(k, v int) bool {
+			if seen[k] {
+				t.Fatalf("key %v visited twice", k)
+			}
+			seen[k] = true
+			if k%2 == 0 {
+				m.Delete(k)
+				m.Store(k, v)
+			}
+			return true
+		})
+		for i := 0; i < 1000; i++ {
+			if !seen[i] {
+				t.Fatalf("key %v not visited", i)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestUpdate(t *testing.T) {
+	m := Make[string, []int]()
+	push := func(v int) func([]int, bool) ([]int, Op) {
+		return func(old []int, loaded bool) ([]int, Op) {
+			return append(old, v), OpStore
+		}
+	}
+	m.Update("a", push(1))
+	if value, ok := m.Update("a", push(2)); !ok || !slices.Equal(value, []int{1, 2}) {
+		t.Fatalf("update a: %v, %v", value, ok)
+	}
+
+	keep := func(old []int, loaded bool) ([]int, Op) { return nil, OpKeep }
+	if value, ok := m.Update("a", keep); !ok || !slices.Equal(value, []int{1, 2}) {
+		t.Fatalf("keep a: %v, %v", value, ok)
+	}
+	if _, ok := m.Update("b", keep); ok {
+		t.Fatalf("keep absent b: ok")
+	}
+	if _, ok := m.Load("b"); ok {
+		t.Fatalf("load b after keep: ok")
+	}
+
+	del := func(old []int, loaded bool) ([]int, Op) {
+		if len(old) > 1 {
+			return nil, OpDelete
+		}
+		return nil, OpKeep
+	}
+	if _, ok := m.Update("a", del); ok {
+		t.Fatalf("delete a: ok")
+	}
+	if n := m.Len(); n != 0 {
+		t.Fatalf("len: %v", n)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := Make[int, int](4)
+	want := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i*10)
+		want[i] = i * 10
+	}
+	snapshot := m.Snapshot()
+	if !maps.Equal(snapshot, want) {
+		t.Fatalf("snapshot: %v", snapshot)
+	}
+	m.Store(0, -1)
+	snapshot[1] = -1
+	if snapshot[0] != 0 {
+		t.Fatalf("snapshot changed by store: %v", snapshot[0])
+	}
+	if value, _ := m.Load(1); value != 10 {
+		t.Fatalf("map changed by snapshot: %v", value)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	keys := []int{200}
+	for i := 0; i < 100; i += 2 {
+		keys = append(keys, i, i)
+	}
+	m.DeleteMany(keys)
+	if n := m.Len(); n != 50 {
+		t.Fatalf("len after delete many: %v", n)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := m.Load(i); ok != (i%2 == 1) {
+			t.Fatalf("load %v after delete many: %v", i, ok)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	n := 0
+	m.Range(func(k, v int) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("range with early exit: %v", n)
+	}
+}
+
+func TestLoadOrCompute(t *testing.T) {
+	m := Make[string, int](1)
+	var computes atomic.Int64
+	release := make(chan struct{})
+	slow := func() int {
+		computes.Add(1)
+		<-release
+		return 42
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	results := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = m.LoadOrCompute("a", slow)
+		}(i)
+	}
+	for computes.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The only bucket is not locked while computing.
+	m.Store("b", 1)
+	if value, ok := m.Load("b"); !ok || value != 1 {
+		t.Fatalf("load b while computing: %v, %v", value, ok)
+	}
+	close(release)
+	wg.Wait()
+	if c := computes.Load(); c != 1 {
+		t.Fatalf("computes: %v", c)
+	}
+	for i, r := range results {
+		if r != 42 {
+			t.Fatalf("result %v: %v", i, r)
+		}
+	}
+	if value, loaded := m.LoadOrCompute("a", slow); !loaded || value != 42 {
+		t.Fatalf("load computed a: %v, %v", value, loaded)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("compute panic: not propagated")
+			}
+		}()
+		m.LoadOrCompute("c", func() int { panic("boom") })
+	}()
+	if value, loaded := m.LoadOrCompute("c", func() int { return 3 }); loaded || value != 3 {
+		t.Fatalf("compute c after panic: %v, %v", value, loaded)
+	}
+
+	// A value stored while computing wins over the computed one.
+	value, loaded := m.LoadOrCompute("d", func() int {
+		m.Store("d", 7)
+		return 42
+	})
+	if !loaded || value != 7 {
+		t.Fatalf("compute d stored meanwhile: %v, %v", value, loaded)
+	}
+	if value, _ := m.Load("d"); value != 7 {
+		t.Fatalf("load d: %v", value)
+	}
+	got, err := m.LoadOrStoreErr(context.Background(), "e", func(context.Context) (int, error) {
+		m.Store("e", 7)
+		return 42, nil
+	})
+	if err != nil || got != 7 {
+		t.Fatalf("load e stored meanwhile: %v, %v", got, err)
+	}
+	if value, _ := m.Load("e"); value != 7 {
+		t.Fatalf("load e: %v", value)
+	}
+}
+
+func TestReadOptimized(t *testing.T) {
+	m := MakeWithOptions[int, int](Options[int]{Buckets: 8, ReadOptimized: true})
+	for i := 0; i < 100; i++ {
+		m.Store(i, i)
+	}
+	for i := 0; i < 100; i++ {
+		if value, ok := m.Load(i); !ok || value != i {
+			t.Fatalf("load %v: %v, %v", i, value, ok)
+		}
+	}
+	m.Store(1, 10)
+	m.Delete(2)
+	m.TransformInPlace(func(k, v int) (int, bool) { return v, k != 3 })
+	if value, _ := m.Load(1); value != 10 {
+		t.Fatalf("load 1 after store: %v", value)
+	}
+	for _, k := range []int{2, 3} {
+		if _, ok := m.Load(k); ok {
+			t.Fatalf("load %v after delete: ok", k)
+		}
+	}
+	m.Rehash(4)
+	m.Store(4, 40)
+	if value, _ := m.Load(4); value != 40 {
+		t.Fatalf("load 4 after rehash: %v", value)
+	}
+	m.Clear()
+	if _, ok := m.Load(1); ok {
+		t.Fatalf("load 1 after clear: ok")
+	}
+
+	// While one Load copies the bucket, the others look it up without copying.
+	m.Store(5, 50)
+	bkt := m.table.Load().get(5)
+	bkt.building.Store(true)
+	if value, ok := m.Load(5); !ok || value != 50 {
+		t.Fatalf("load 5 while building: %v, %v", value, ok)
+	}
+	if bkt.read.Load() != nil {
+		t.Fatalf("load 5 while building: copied")
+	}
+	bkt.building.Store(false)
+	m.Load(5)
+	if bkt.read.Load() == nil {
+		t.Fatalf("load 5: not copied")
+	}
+
+	// Readers never see a value older than one they have seen.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := 0
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				value, _ := m.Load(0)
+				if value < last {
+					t.Errorf("load 0: %v after %v", value, last)
+					return
+				}
+				last = value
+			}
+		}()
+	}
+	for i := 1; i <= 1000; i++ {
+		m.Store(0, i)
+		if i%100 == 0 {
+			m.Rehash(1 + i/100)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkLoadReadOptimized(b *testing.B) {
+	m := MakeWithOptions[int, int](Options[int]{ReadOptimized: true})
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m.Load(i % 1000)
+		}
+	})
+}
+
+func BenchmarkLoadParallel(b *testing.B) {
+	m := Make[int, int]()
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m.Load(i % 1000)
+		}
+	})
+}
+
+func TestIterSorted(t *testing.T) {
+	m := Make[int, int](4)
+	for _, i := range []int{5, 3, 9, 1, 7, 2, 8, 0, 6, 4} {
+		m.Store(i, i*10)
+	}
+	var keys []int
+	IterSorted(m)(func(k, v int) bool {
+		if v != k*10 {
+			t.Fatalf("iter sorted %v: %v", k, v)
+		}
+		keys = append(keys, k)
+		return true
+	})
+	if !slices.Equal(keys, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Fatalf("iter sorted: %v", keys)
+	}
+
+	keys = nil
+	Between(m, 3, 7)(func(k, v int) bool {
+		keys = append(keys, k)
+		return len(keys) < 3
+	})
+	if !slices.Equal(keys, []int{3, 4, 5}) {
+		t.Fatalf("between 3, 7 with early exit: %v", keys)
+	}
+	Between(m, 7, 3)(func(k, v int) bool {
+		t.Fatalf("between 7, 3: yields %v", k)
+		return true
+	})
+}
+
+func TestReposition(t *testing.T) {
+	type shardKey struct{ shard int }
+	m := MakeWithOptions[*shardKey, int](Options[*shardKey]{
+		Buckets:       4,
+		Hash:          func(k *shardKey) uint64 { return uint64(k.shard) },
+		TrackVersions: true,
+	})
+	a, b := &shardKey{1}, &shardKey{2}
+	m.Store(a, 10)
+	m.Store(b, 20)
+	version := m.Version()
+	if m.Reposition(a) {
+		t.Fatalf("reposition key in place")
+	}
+
+	a.shard = 3
+	if _, ok := m.Load(a); ok {
+		t.Fatalf("load key with changed hash ok")
+	}
+	if !m.Reposition(a) {
+		t.Fatalf("reposition key with changed hash failed")
+	}
+	if v, ok := m.Load(a); !ok || v != 10 {
+		t.Fatalf("load repositioned key: %v, %v", v, ok)
+	}
+	if v, ok := m.Load(b); !ok || v != 20 {
+		t.Fatalf("load other key: %v, %v", v, ok)
+	}
+	if m.Len() != 2 || m.Version() != version {
+		t.Fatalf("reposition len: %v, version: %v, want %v", m.Len(), m.Version(), version)
+	}
+	if m.Reposition(a) || m.Reposition(&shardKey{0}) {
+		t.Fatalf("reposition key in place or absent")
+	}
+
+	lb := m.LockBucket(3)
+	_, ok := lb.Load(a)
+	m.UnlockBucket(3)
+	if !ok {
+		t.Fatalf("repositioned key not in bucket 3")
+	}
+}
+
+func TestClone(t *testing.T) {
+	m := MakeWithOptions[string, int](Options[string]{Buckets: 4, NormalizeKey: strings.ToLower})
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		m.Store(k, i)
+	}
+	c := m.Clone()
+	if c.NumBuckets() != 4 || c.Len() != 5 {
+		t.Fatalf("clone: %v buckets, %v entries", c.NumBuckets(), c.Len())
+	}
+	if !maps.Equal(c.Snapshot(), m.Snapshot()) {
+		t.Fatalf("clone: %v", c.Snapshot())
+	}
+	if value, ok := c.Load("C"); !ok || value != 2 {
+		t.Fatalf("load normalized c from clone: %v, %v", value, ok)
+	}
+
+	c.Store("a", 10)
+	c.Delete("b")
+	m.Store("f", 5)
+	if value, _ := m.Load("a"); value != 0 {
+		t.Fatalf("map changed by clone: %v", value)
+	}
+	if _, ok := c.Load("f"); ok {
+		t.Fatalf("clone changed by map: ok")
+	}
+	if c.Len() != 4 || m.Len() != 6 {
+		t.Fatalf("len: clone %v, map %v", c.Len(), m.Len())
+	}
+}
+
+func BenchmarkStoreParallel(b *testing.B) {
+	m := Make[int, int](64)
+	var id atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine writes its own key, so buckets are not contended,
+		// but adjacent buckets may share cache lines.
+		key := int(id.Add(1))
+		for pb.Next() {
+			m.Store(key, key)
+		}
+	})
+}
+
+func TestBucketPadding(t *testing.T) {
+	sizes := []uintptr{
+		unsafe.Sizeof(bucket[int, int]{}),
+		unsafe.Sizeof(bucket[string, []byte]{}),
+		unsafe.Sizeof(bucket[[64]byte, struct{}]{}),
+	}
+	for _, size := range sizes {
+		if size%cacheLine != 0 || size != sizes[0] {
+			t.Fatalf("bucket sizes: %v, want a multiple of %v", sizes, cacheLine)
+		}
+	}
+}
+
+func TestLoadOrStoreErr(t *testing.T) {
+	m := Make[string, int]()
+	ctx := context.Background()
+	errLoad := errors.New("load failed")
+
+	var loads atomic.Int64
+	release := make(chan struct{})
+	failing := func(context.Context) (int, error) {
+		loads.Add(1)
+		<-release
+		return 1, errLoad
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = m.LoadOrStoreErr(ctx, "a", failing)
+		}(i)
+	}
+	for loads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	for i, err := range errs {
+		if !errors.Is(err, errLoad) {
+			t.Fatalf("load error %v: %v", i, err)
+		}
+	}
+	if _, ok := m.Load("a"); ok {
+		t.Fatalf("load a after failed load: ok")
+	}
+
+	ok := func(context.Context) (int, error) { return 2, nil }
+	if value, err := m.LoadOrStoreErr(ctx, "a", ok); err != nil || value != 2 {
+		t.Fatalf("load a: %v, %v", value, err)
+	}
+	if value, err := m.LoadOrStoreErr(ctx, "a", failing); err != nil || value != 2 {
+		t.Fatalf("load stored a: %v, %v", value, err)
+	}
+
+	// A waiter gives up when its context is done,
+	// and a loader whose context is done hands over to another caller.
+	started := make(chan struct{})
+	blocking := func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	loaderCtx, cancelLoader := context.WithCancel(ctx)
+	loaded := make(chan error, 1)
+	go func() {
+		_, err := m.LoadOrStoreErr(loaderCtx, "b", blocking)
+		loaded <- err
+	}()
+	<-started
+	waiterCtx, cancelWaiter := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelWaiter()
+	if _, err := m.LoadOrStoreErr(waiterCtx, "b", ok); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait for b: %v", err)
+	}
+	next := make(chan int, 1)
+	go func() {
+		value, _ := m.LoadOrStoreErr(ctx, "b", ok)
+		next <- value
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancelLoader()
+	if err := <-loaded; !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled load of b: %v", err)
+	}
+	if value := <-next; value != 2 {
+		t.Fatalf("load b after handover: %v", value)
+	}
+}
@@ -0,0 +1,26 @@
+package bucketmap
+
+// ComparableMap is a Map of comparable values,
+// offering CompareAndSwap and CompareAndDelete as methods, like sync.Map.
+// All the methods of Map are available through the embedded Map.
+type ComparableMap[K, V comparable] struct {
+	*Map[K, V]
+}
+
+// MakeComparable makes a ComparableMap with default 31 buckets.
+func MakeComparable[K, V comparable](buckets ...int) *ComparableMap[K, V] {
+	return &ComparableMap[K, V]{Make[K, V](buckets...)}
+}
+
+// CompareAndSwap swaps the old and new values for a key
+// if the value stored in the Map is equal to old.
+// It reports false, storing nothing, if the key is absent.
+func (m *ComparableMap[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	return CompareAndSwap(m.Map, key, old, new)
+}
+
+// CompareAndDelete deletes the entry for a key if its value is equal to old.
+// It reports false, changing nothing, if the key is absent or the value differs.
+func (m *ComparableMap[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	return CompareAndDelete(m.Map, key, old)
+}
@@ -0,0 +1,45 @@
+package bucketmap
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestComparableMap(t *testing.T) {
+	m := MakeComparable[string, int]()
+	if m.CompareAndSwap("a", 0, 1) {
+		t.Fatalf("compare and swap absent a: true")
+	}
+	m.Store("a", 1)
+	if !m.CompareAndSwap("a", 1, 2) {
+		t.Fatalf("compare and swap a: false")
+	}
+	if m.CompareAndDelete("a", 1) {
+		t.Fatalf("compare and delete a mismatch: true")
+	}
+	if !m.CompareAndDelete("a", 2) {
+		t.Fatalf("compare and delete a: false")
+	}
+	if !m.Empty() {
+		t.Fatalf("len after compare and delete: %v", m.Len())
+	}
+
+	m.Store("n", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; {
+				old, _ := m.Load("n")
+				if m.CompareAndSwap("n", old, old+1) {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := m.Load("n"); n != 8000 {
+		t.Fatalf("optimistic increments: %v", n)
+	}
+}
@@ -0,0 +1,261 @@
+package bucketmap
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ExpiringMap is a Map whose entries expire after a time to live,
+// for use as an in-process cache.
+//
+// Expired entries are treated as absent, and are reclaimed lazily
+// by Load, or in bulk by Sweep and Janitor.
+// Until reclaimed, they still count in Len.
+type ExpiringMap[K comparable, V any] struct {
+	m   *Map[K, expiring[V]]
+	ttl time.Duration
+	now func() time.Time
+
+	onEvict   atomic.Pointer[func(key K, value V)]
+	evictions evictionCounts
+}
+
+type expiring[V any] struct {
+	value V
+
+	// deadline is when the entry expires, or zero if it never expires.
+	deadline time.Time
+}
+
+func (e expiring[V]) expired(now time.Time) bool {
+	return !e.deadline.IsZero() && !now.Before(e.deadline)
+}
+
+// MakeExpiring makes an ExpiringMap whose entries stored by Store expire
+// after ttl, or never if ttl <= 0, with default 31 buckets.
+func MakeExpiring[K comparable, V any](ttl time.Duration, buckets ...int) *ExpiringMap[K, V] {
+	return &ExpiringMap[K, V]{
+		m:   Make[K, expiring[V]](buckets...),
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+// OnEvict registers fn to be called with every entry reclaimed because it expired,
+// replacing any fn registered before.
+// It is not called for entries deleted or overwritten, but is for entries flushed by Flush.
+// fn is called after releasing the bucket locks, so it may call into the ExpiringMap.
+func (x *ExpiringMap[K, V]) OnEvict(fn func(key K, value V)) {
+	x.onEvict.Store(&fn)
+}
+
+func (x *ExpiringMap[K, V]) evicted(key K, value V) {
+	x.evictions.expired.Add(1)
+	if fn := x.onEvict.Load(); fn != nil && *fn != nil {
+		(*fn)(key, value)
+	}
+}
+
+func (x *ExpiringMap[K, V]) deadline(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return x.now().Add(ttl)
+}
+
+// Store sets the value for a key, expiring after the default time to live.
+func (x *ExpiringMap[K, V]) Store(key K, value V) {
+	x.StoreTTL(key, value, x.ttl)
+}
+
+// StoreTTL sets the value for a key, expiring after ttl, or never if ttl <= 0.
+func (x *ExpiringMap[K, V]) StoreTTL(key K, value V, ttl time.Duration) {
+	x.m.Store(key, expiring[V]{value, x.deadline(ttl)})
+}
+
+// StoreUntil sets the value for a key, expiring at deadline.
+// If deadline is not after now, the value expires right away,
+// so the key ends up absent, any value stored before deleted.
+func (x *ExpiringMap[K, V]) StoreUntil(key K, value V, deadline time.Time) {
+	if !deadline.After(x.now()) {
+		x.m.Delete(key)
+		return
+	}
+	x.m.Store(key, expiring[V]{value, deadline})
+}
+
+// StoreOrTouch stores value for a key with the default time to live
+// if the key is absent or expired, and reports true.
+// Otherwise, it keeps the value and only resets its expiry
+// to the default time to live, and reports false.
+// The expired entry replaced, if any, is reported to the OnEvict callback.
+func (x *ExpiringMap[K, V]) StoreOrTouch(key K, value V) (stored bool) {
+	now := x.now()
+	var e expiring[V]
+	var evicted bool
+	deadline := x.deadline(x.ttl)
+	x.m.Update(key, func(old expiring[V], loaded bool) (expiring[V], Op) {
+		if loaded && !old.expired(now) {
+			return expiring[V]{old.value, deadline}, OpStore
+		}
+		e, evicted = old, loaded
+		stored = true
+		return expiring[V]{value, deadline}, OpStore
+	})
+	if evicted {
+		x.evicted(x.m.normalize(key), e.value)
+	}
+	return
+}
+
+// Load returns the value stored for a key, or zero value if no value is present
+// or it has expired, in which case the entry is reclaimed.
+// The ok result indicates whether an unexpired value was found.
+func (x *ExpiringMap[K, V]) Load(key K) (value V, ok bool) {
+	e, ok := x.m.Load(key)
+	if !ok {
+		return
+	}
+	if now := x.now(); e.expired(now) {
+		x.reclaim(key, now)
+		return value, false
+	}
+	return e.value, true
+}
+
+// reclaim deletes the entry for a key if it has expired at now,
+// and reports it to the OnEvict callback.
+func (x *ExpiringMap[K, V]) reclaim(key K, now time.Time) {
+	var e expiring[V]
+	var evicted bool
+	x.m.Update(key, func(old expiring[V], loaded bool) (expiring[V], Op) {
+		if loaded && old.expired(now) {
+			e, evicted = old, true
+			return old, OpDelete
+		}
+		return old, OpKeep
+	})
+	if evicted {
+		x.evicted(x.m.normalize(key), e.value)
+	}
+}
+
+// Delete deletes the value for a key.
+func (x *ExpiringMap[K, V]) Delete(key K) {
+	if _, deleted := x.m.LoadAndDelete(key); deleted {
+		x.evictions.manual.Add(1)
+	}
+}
+
+// EvictionStats returns the numbers of entries reclaimed because they expired,
+// as reported to the OnEvict callback, and deleted by Delete.
+// An ExpiringMap has no capacity, so capacity is zero.
+func (x *ExpiringMap[K, V]) EvictionStats() (expired, capacity, manual uint64) {
+	return x.evictions.stats()
+}
+
+// Flush deletes all the entries at once, as SwapOut of Map, resets the eviction stats,
+// and then calls the OnEvict callback for every entry deleted, expired or not.
+// Evictions counted between the delete and the reset are reset too.
+func (x *ExpiringMap[K, V]) Flush() {
+	flushed := x.m.SwapOut()
+	x.evictions.reset()
+	if fn := x.onEvict.Load(); fn != nil && *fn != nil {
+		for k, e := range flushed {
+			(*fn)(k, e.value)
+		}
+	}
+}
+
+// Len returns the number of entries, including the expired ones not reclaimed yet.
+func (x *ExpiringMap[K, V]) Len() int {
+	return x.m.Len()
+}
+
+// Iter returns an iterator over the unexpired key-value pairs, as Map.Iter.
+// Expired entries are skipped, not reclaimed.
+func (x *ExpiringMap[K, V]) Iter() func(yield func(K, V) bool) {
+	return func(yield func(K, V) bool) {
+		now := x.now()
+		x.m.Iter()(func(k K, e expiring[V]) bool {
+			if e.expired(now) {
+				return true
+			}
+			return yield(k, e.value)
+		})
+	}
+}
+
+// Sweep reclaims all the expired entries, and returns the number of them.
+// The OnEvict callback is called for them after all the buckets are swept.
+func (x *ExpiringMap[K, V]) Sweep() int {
+	now := x.now()
+	var evicted []Pair[K, V]
+	x.m.DeleteFunc(func(k K, e expiring[V]) bool {
+		if e.expired(now) {
+			evicted = append(evicted, Pair[K, V]{k, e.value})
+			return true
+		}
+		return false
+	})
+	for _, p := range evicted {
+		x.evicted(p.Key, p.Value)
+	}
+	return len(evicted)
+}
+
+// ExtendAll adds by to the time to live of every unexpired entry,
+// in one pass write locking each bucket in turn, as ReplaceFunc of Map.
+// Entries expired already are not resurrected, but left to be reclaimed,
+// and entries never expiring are left as is.
+func (x *ExpiringMap[K, V]) ExtendAll(by time.Duration) {
+	now := x.now()
+	x.m.ReplaceFunc(func(k K, e expiring[V]) (expiring[V], bool) {
+		if e.deadline.IsZero() || e.expired(now) {
+			return e, false
+		}
+		return expiring[V]{e.value, e.deadline.Add(by)}, true
+	})
+}
+
+// LongestLived returns the key whose entry has the longest time to live left,
+// and that time, treating expired entries as absent.
+// An entry never expiring outlives any other, and is reported with
+// the longest time.Duration, math.MaxInt64; which of several such entries
+// is reported is unspecified.
+// The ok result reports false if there is no unexpired entry.
+// The entries are scanned bucket by bucket, as by Iter.
+func (x *ExpiringMap[K, V]) LongestLived() (key K, ttl time.Duration, ok bool) {
+	now := x.now()
+	x.m.Iter()(func(k K, e expiring[V]) bool {
+		if e.expired(now) {
+			return true
+		}
+		left := time.Duration(math.MaxInt64)
+		if !e.deadline.IsZero() {
+			left = e.deadline.Sub(now)
+		}
+		if !ok || left > ttl {
+			key, ttl, ok = k, left, true
+		}
+		return left != math.MaxInt64
+	})
+	return
+}
+
+// Janitor calls Sweep every interval until ctx is done.
+// It blocks, so it is typically run in its own goroutine.
+func (x *ExpiringMap[K, V]) Janitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			x.Sweep()
+		}
+	}
+}
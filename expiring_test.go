@@ -0,0 +1,261 @@
+package bucketmap
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock advanced manually by tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestExpiringMap(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[string, int](time.Minute)
+	x.now = clock.Now
+	var evicted []string
+	x.OnEvict(func(key string, value int) {
+		x.Load(key) // the bucket locks are released
+		evicted = append(evicted, key)
+	})
+
+	x.Store("a", 1)
+	x.StoreTTL("b", 2, time.Hour)
+	x.StoreTTL("c", 3, 0)
+	if value, ok := x.Load("a"); !ok || value != 1 {
+		t.Fatalf("load a: %v, %v", value, ok)
+	}
+
+	clock.Advance(time.Minute)
+	if value, ok := x.Load("a"); ok {
+		t.Fatalf("load expired a: %v", value)
+	}
+	if !slices.Equal(evicted, []string{"a"}) {
+		t.Fatalf("evicted: %v", evicted)
+	}
+	if n := x.Len(); n != 2 {
+		t.Fatalf("len after reclaiming a: %v", n)
+	}
+
+	clock.Advance(time.Hour)
+	var keys []string
+	x.Iter()(func(k string, v int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if !slices.Equal(keys, []string{"c"}) {
+		t.Fatalf("iter: %v", keys)
+	}
+	if n := x.Sweep(); n != 1 {
+		t.Fatalf("sweep: %v", n)
+	}
+	if !slices.Equal(evicted, []string{"a", "b"}) {
+		t.Fatalf("evicted: %v", evicted)
+	}
+	if value, ok := x.Load("c"); !ok || value != 3 {
+		t.Fatalf("load c never expiring: %v, %v", value, ok)
+	}
+
+	x.StoreTTL("d", 4, time.Second)
+	x.Delete("d")
+	clock.Advance(time.Second)
+	if n := x.Sweep(); n != 0 || len(evicted) != 2 {
+		t.Fatalf("sweep deleted d: %v, %v", n, evicted)
+	}
+}
+
+func TestStoreUntil(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[string, int](time.Minute)
+	x.now = clock.Now
+
+	x.StoreUntil("a", 1, clock.Now().Add(time.Second))
+	if value, ok := x.Load("a"); !ok || value != 1 {
+		t.Fatalf("load a: %v, %v", value, ok)
+	}
+	clock.Advance(time.Second)
+	if _, ok := x.Load("a"); ok {
+		t.Fatalf("load a after deadline: ok")
+	}
+
+	x.Store("b", 2)
+	x.StoreUntil("b", 3, clock.Now().Add(-time.Second))
+	if _, ok := x.Load("b"); ok || x.Len() != 0 {
+		t.Fatalf("load b with past deadline: %v, len %v", ok, x.Len())
+	}
+}
+
+func TestStoreOrTouch(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[string, int](time.Minute)
+	x.now = clock.Now
+	var evicted []string
+	x.OnEvict(func(key string, value int) {
+		evicted = append(evicted, key)
+	})
+
+	if !x.StoreOrTouch("a", 1) {
+		t.Fatalf("store a: not stored")
+	}
+	clock.Advance(50 * time.Second)
+	if x.StoreOrTouch("a", 2) {
+		t.Fatalf("touch a: stored")
+	}
+	clock.Advance(50 * time.Second)
+	if value, ok := x.Load("a"); !ok || value != 1 {
+		t.Fatalf("load touched a: %v, %v", value, ok)
+	}
+
+	clock.Advance(time.Minute)
+	if !x.StoreOrTouch("a", 3) {
+		t.Fatalf("store expired a: not stored")
+	}
+	if value, ok := x.Load("a"); !ok || value != 3 {
+		t.Fatalf("load a stored again: %v, %v", value, ok)
+	}
+	if !slices.Equal(evicted, []string{"a"}) || x.Len() != 1 {
+		t.Fatalf("evicted: %v, len %v", evicted, x.Len())
+	}
+}
+
+func TestExtendAll(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[string, int](time.Minute)
+	x.now = clock.Now
+
+	x.Store("a", 1)
+	x.StoreTTL("b", 2, time.Second)
+	x.StoreTTL("c", 3, 0)
+	x.StoreTTL("d", 4, 2*time.Minute)
+	clock.Advance(time.Second)
+	x.ExtendAll(time.Minute)
+
+	clock.Advance(90 * time.Second)
+	for k, want := range map[string]int{"a": 1, "c": 3, "d": 4} {
+		if value, ok := x.Load(k); !ok || value != want {
+			t.Fatalf("load extended %v: %v, %v", k, value, ok)
+		}
+	}
+	if _, ok := x.Load("b"); ok {
+		t.Fatalf("load b expired before extending: ok")
+	}
+
+	clock.Advance(30 * time.Second)
+	if _, ok := x.Load("a"); ok {
+		t.Fatalf("load a after extended deadline: ok")
+	}
+	clock.Advance(time.Minute)
+	if _, ok := x.Load("d"); ok {
+		t.Fatalf("load d after extended deadline: ok")
+	}
+}
+
+func TestLongestLived(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[string, int](time.Minute)
+	x.now = clock.Now
+	if _, _, ok := x.LongestLived(); ok {
+		t.Fatalf("longest lived of empty map: ok")
+	}
+
+	x.StoreTTL("a", 1, time.Minute)
+	x.StoreTTL("b", 2, time.Hour)
+	x.StoreTTL("c", 3, time.Second)
+	clock.Advance(time.Second)
+	if key, ttl, ok := x.LongestLived(); !ok || key != "b" || ttl != time.Hour-time.Second {
+		t.Fatalf("longest lived: %v, %v, %v", key, ttl, ok)
+	}
+
+	clock.Advance(time.Hour)
+	if _, _, ok := x.LongestLived(); ok {
+		t.Fatalf("longest lived of expired entries: ok")
+	}
+
+	x.StoreTTL("d", 4, 0)
+	x.Store("e", 5)
+	if key, ttl, ok := x.LongestLived(); !ok || key != "d" || ttl != math.MaxInt64 {
+		t.Fatalf("longest lived never expiring: %v, %v, %v", key, ttl, ok)
+	}
+}
+
+func TestExpiringMapEvictionStats(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[int, int](time.Minute)
+	x.now = clock.Now
+	for i := 0; i < 4; i++ {
+		x.Store(i, i)
+	}
+	x.Delete(0)
+	x.Delete(0)
+	clock.Advance(time.Minute)
+	x.Load(1)
+	x.Sweep()
+	if expired, capacity, manual := x.EvictionStats(); expired != 3 || capacity != 0 || manual != 1 {
+		t.Fatalf("eviction stats: %v, %v, %v", expired, capacity, manual)
+	}
+}
+
+func TestExpiringMapFlush(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	x := MakeExpiring[int, int](time.Minute)
+	x.now = clock.Now
+	for i := 0; i < 3; i++ {
+		x.Store(i, i)
+	}
+	x.Delete(0)
+	clock.Advance(time.Minute)
+	x.Sweep()
+	x.Store(3, 3)
+	x.StoreTTL(4, 4, 0)
+	flushed := make(map[int]int)
+	x.OnEvict(func(key, value int) { flushed[key] = value })
+	x.Flush()
+	if len(flushed) != 2 || flushed[3] != 3 || flushed[4] != 4 {
+		t.Fatalf("flushed: %v", flushed)
+	}
+	if x.Len() != 0 {
+		t.Fatalf("expiring map len: %v", x.Len())
+	}
+	if expired, capacity, manual := x.EvictionStats(); expired != 0 || capacity != 0 || manual != 0 {
+		t.Fatalf("eviction stats: %v, %v, %v", expired, capacity, manual)
+	}
+}
+
+func TestExpiringMapJanitor(t *testing.T) {
+	x := MakeExpiring[int, int](time.Millisecond)
+	for i := 0; i < 100; i++ {
+		x.Store(i, i)
+	}
+	done := make(chan struct{})
+	x.OnEvict(func(key, value int) {
+		if key == 99 {
+			close(done)
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go x.Janitor(ctx, time.Millisecond)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("janitor: 99 not evicted")
+	}
+}
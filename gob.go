@@ -0,0 +1,66 @@
+package bucketmap
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// WriteTo writes the entries to w as a gob stream of Pairs, to be read by ReadFrom.
+// The entries are copied and written bucket by bucket,
+// so the Map is never copied as a whole, and no lock is held while writing.
+// It returns the number of bytes written.
+func (m *Map[K, V]) WriteTo(w io.Writer) (n int64, err error) {
+	cw := &countWriter{w: w}
+	enc := gob.NewEncoder(cw)
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		for _, p := range t.buckets[i].pairs() {
+			if err = enc.Encode(p); err != nil {
+				return cw.n, fmt.Errorf("bucketmap: write gob of key %v: %w", p.Key, err)
+			}
+		}
+	}
+	return cw.n, nil
+}
+
+// ReadFrom reads a gob stream of Pairs written by WriteTo from r until EOF,
+// and stores the entries into the Map, keeping its buckets and other entries.
+// It returns the number of bytes read.
+func (m *Map[K, V]) ReadFrom(r io.Reader) (n int64, err error) {
+	cr := &countReader{r: r}
+	dec := gob.NewDecoder(cr)
+	for {
+		var p Pair[K, V]
+		if err = dec.Decode(&p); err != nil {
+			if errors.Is(err, io.EOF) {
+				return cr.n, nil
+			}
+			return cr.n, fmt.Errorf("bucketmap: read gob: %w", err)
+		}
+		m.Store(p.Key, p.Value)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
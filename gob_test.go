@@ -0,0 +1,57 @@
+package bucketmap
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	m := Make[string, point](4)
+	want := make(map[string]point)
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		m.Store(k, point{i, -i})
+		want[k] = point{i, -i}
+	}
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("write to: %v", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("write to: %v bytes, buffered %v", n, buf.Len())
+	}
+
+	size := buf.Len()
+	r := Make[string, point](7)
+	r.Store("f", point{5, 5})
+	if n, err = r.ReadFrom(&buf); err != nil {
+		t.Fatalf("read from: %v", err)
+	}
+	if n != int64(size) {
+		t.Fatalf("read from: %v bytes, written %v", n, size)
+	}
+	want["f"] = point{5, 5}
+	if got := r.Snapshot(); !maps.Equal(got, want) {
+		t.Fatalf("read from: %v", got)
+	}
+
+	if _, err = Make[string, int]().ReadFrom(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Fatalf("read from garbage: no error")
+	}
+	type hidden struct {
+		x int
+	}
+	h := Make[string, hidden]()
+	if _, err = h.WriteTo(&buf); err != nil {
+		t.Fatalf("write empty map of unexported fields: %v", err)
+	}
+	h.Store("h", hidden{1})
+	if _, err = h.WriteTo(&buf); err == nil {
+		t.Fatalf("write unexported fields: no error")
+	}
+}
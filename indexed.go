@@ -0,0 +1,101 @@
+package bucketmap
+
+// IndexedMap is a Map maintaining a secondary index over its values,
+// so that keys can also be looked up by an attribute of their values.
+//
+// The index is updated while the bucket of the primary key is locked,
+// so it is always consistent with the entries.
+type IndexedMap[K comparable, V any, I comparable] struct {
+	m       *Map[K, V]
+	index   *Map[I, map[K]struct{}]
+	indexOf func(V) I
+}
+
+// MakeIndexed makes an IndexedMap indexing values by indexOf,
+// with default 31 buckets for both the entries and the index.
+func MakeIndexed[K comparable, V any, I comparable](indexOf func(V) I, buckets ...int) *IndexedMap[K, V, I] {
+	return &IndexedMap[K, V, I]{
+		m:       Make[K, V](buckets...),
+		index:   Make[I, map[K]struct{}](buckets...),
+		indexOf: indexOf,
+	}
+}
+
+// link adds key to the keys of index i.
+// It must be called with the bucket of key locked.
+func (x *IndexedMap[K, V, I]) link(i I, key K) {
+	bkt, i := x.index.lock(i)
+	keys := bkt.m[i]
+	if keys == nil {
+		keys = make(map[K]struct{})
+		x.index.put(bkt, i, keys)
+	}
+	keys[key] = struct{}{}
+	bkt.Unlock()
+}
+
+// unlink removes key from the keys of index i.
+// It must be called with the bucket of key locked.
+func (x *IndexedMap[K, V, I]) unlink(i I, key K) {
+	bkt, i := x.index.lock(i)
+	keys := bkt.m[i]
+	delete(keys, key)
+	if len(keys) == 0 {
+		x.index.remove(bkt, i)
+	}
+	bkt.Unlock()
+}
+
+// Load returns the value stored in the map for a key,
+// or zero value if no value is present.
+// The ok result indicates whether value was found in the map.
+func (x *IndexedMap[K, V, I]) Load(key K) (value V, ok bool) {
+	return x.m.Load(key)
+}
+
+// Store sets the value for a key.
+func (x *IndexedMap[K, V, I]) Store(key K, value V) {
+	x.Swap(key, value)
+}
+
+// Swap swaps the value for a key and returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (x *IndexedMap[K, V, I]) Swap(key K, value V) (previous V, loaded bool) {
+	bkt, key := x.m.lock(key)
+	defer bkt.Unlock()
+	previous, loaded = bkt.m[key]
+	x.m.put(bkt, key, value)
+
+	i := x.indexOf(value)
+	if loaded {
+		old := x.indexOf(previous)
+		if old == i {
+			return
+		}
+		x.unlink(old, key)
+	}
+	x.link(i, key)
+	return
+}
+
+// Delete deletes the value for a key.
+func (x *IndexedMap[K, V, I]) Delete(key K) {
+	bkt, key := x.m.lock(key)
+	defer bkt.Unlock()
+	if value, ok := bkt.m[key]; ok {
+		i := x.indexOf(value)
+		x.m.remove(bkt, key)
+		x.unlink(i, key)
+	}
+}
+
+// ByIndex returns the keys whose values are indexed by i, in no particular order.
+func (x *IndexedMap[K, V, I]) ByIndex(i I) []K {
+	bkt, i := x.index.rlock(i)
+	defer bkt.RUnlock()
+	keys := make([]K, 0, len(bkt.m[i]))
+	for key := range bkt.m[i] {
+		keys = append(keys, key)
+	}
+	return keys
+}
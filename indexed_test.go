@@ -0,0 +1,75 @@
+package bucketmap
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestIndexedMap(t *testing.T) {
+	type user struct {
+		name string
+		city string
+	}
+	m := MakeIndexed[int, user](func(u user) string { return u.city })
+	byCity := func(city string) []int {
+		keys := m.ByIndex(city)
+		slices.Sort(keys)
+		return keys
+	}
+
+	m.Store(1, user{"alice", "paris"})
+	m.Store(2, user{"bob", "paris"})
+	m.Store(3, user{"carol", "tokyo"})
+	if keys := byCity("paris"); !slices.Equal(keys, []int{1, 2}) {
+		t.Fatalf("by paris: %v", keys)
+	}
+	if keys := byCity("tokyo"); !slices.Equal(keys, []int{3}) {
+		t.Fatalf("by tokyo: %v", keys)
+	}
+
+	if previous, loaded := m.Swap(2, user{"bob", "tokyo"}); !loaded || previous.city != "paris" {
+		t.Fatalf("swap 2: %v, %v", previous, loaded)
+	}
+	if keys := byCity("paris"); !slices.Equal(keys, []int{1}) {
+		t.Fatalf("by paris: %v", keys)
+	}
+	if keys := byCity("tokyo"); !slices.Equal(keys, []int{2, 3}) {
+		t.Fatalf("by tokyo: %v", keys)
+	}
+
+	m.Store(1, user{"alice", "paris"})
+	m.Delete(1)
+	m.Delete(4)
+	if keys := byCity("paris"); len(keys) != 0 {
+		t.Fatalf("by paris: %v", keys)
+	}
+	if u, ok := m.Load(2); !ok || u.name != "bob" {
+		t.Fatalf("load 2: %v, %v", u, ok)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cities := []string{"paris", "tokyo", "rome"}
+			for j := 0; j < 300; j++ {
+				m.Store(j%20, user{"x", cities[(i+j)%3]})
+			}
+		}(i)
+	}
+	wg.Wait()
+	n := 0
+	for _, city := range []string{"paris", "tokyo", "rome"} {
+		for _, key := range byCity(city) {
+			if u, _ := m.Load(key); u.city != city {
+				t.Fatalf("indexed %v by %v: %v", key, city, u.city)
+			}
+			n++
+		}
+	}
+	if n != 20 {
+		t.Fatalf("indexed keys: %v", n)
+	}
+}
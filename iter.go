@@ -0,0 +1,31 @@
+//go:build go1.23
+
+package bucketmap
+
+import "iter"
+
+// All returns an iterator over key-value pairs in the Map, as Iter,
+// for use in range loops.
+func (m *Map[K, V]) All() iter.Seq2[K, V] {
+	return m.Iter()
+}
+
+// AllKeys returns an iterator over the keys in the Map, as Iter.
+// Unlike Keys, it does not collect the keys in a slice.
+func (m *Map[K, V]) AllKeys() iter.Seq[K] {
+	return func(yield func(K) bool) {
+		m.Iter()(func(k K, _ V) bool {
+			return yield(k)
+		})
+	}
+}
+
+// AllValues returns an iterator over the values in the Map, as Iter.
+// Unlike Values, it does not collect the values in a slice.
+func (m *Map[K, V]) AllValues() iter.Seq[V] {
+	return func(yield func(V) bool) {
+		m.Iter()(func(_ K, v V) bool {
+			return yield(v)
+		})
+	}
+}
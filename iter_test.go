@@ -0,0 +1,40 @@
+//go:build go1.23
+
+package bucketmap
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	m := Make[int, int](4)
+	want := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		m.Store(i, i*10)
+		want[i] = i * 10
+	}
+	if got := maps.Collect(m.All()); !maps.Equal(got, want) {
+		t.Fatalf("all: %v", got)
+	}
+
+	keys := slices.Sorted(m.AllKeys())
+	values := slices.Sorted(m.AllValues())
+	for i := 0; i < 100; i++ {
+		if keys[i] != i || values[i] != i*10 {
+			t.Fatalf("keys and values %v: %v, %v", i, keys[i], values[i])
+		}
+	}
+
+	n := 0
+	for k := range m.AllKeys() {
+		m.Delete(k)
+		if n++; n == 10 {
+			break
+		}
+	}
+	if l := m.Len(); l != 90 {
+		t.Fatalf("len after break: %v", l)
+	}
+}
@@ -0,0 +1,115 @@
+package bucketmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type jsonLine[K comparable, V any] struct {
+	Key   K `json:"key"`
+	Value V `json:"value"`
+}
+
+// WriteJSONLines writes the entries to w as JSON Lines,
+// one object {"key":...,"value":...} per line.
+// The entries are copied and written bucket by bucket,
+// so the Map is never copied as a whole.
+func (m *Map[K, V]) WriteJSONLines(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	t := m.table.Load()
+	for i := 0; i < len(t.buckets); i++ {
+		for _, p := range t.buckets[i].pairs() {
+			err := enc.Encode(jsonLine[K, V]{p.Key, p.Value})
+			if err != nil {
+				return fmt.Errorf("bucketmap: write json line of key %v: %w", p.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes the entries as a JSON object, as encoding/json
+// encodes a map[K]V, so K must be a string, an integer,
+// or implement encoding.TextMarshaler; otherwise an error is returned.
+// If the Map is made with KeyToString of Options, keys are converted
+// by it instead, so K may be any type.
+// The entries are copied bucket by bucket, each under its read lock.
+func (m *Map[K, V]) MarshalJSON() ([]byte, error) {
+	entries := make(map[K]V, m.Len())
+	if t := m.table.Load(); t != nil {
+		for i := 0; i < len(t.buckets); i++ {
+			bkt := &t.buckets[i]
+			bkt.RLock()
+			for k, v := range bkt.m {
+				entries[k] = v
+			}
+			bkt.RUnlock()
+		}
+	}
+	if m.keyToString != nil {
+		return m.marshalStringKeys(entries)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return nil, fmt.Errorf("bucketmap: marshal json: %w", err)
+	}
+	return data, nil
+}
+
+func (m *Map[K, V]) marshalStringKeys(entries map[K]V) ([]byte, error) {
+	strs := make(map[string]V, len(entries))
+	for k, v := range entries {
+		s, err := m.keyToString(k)
+		if err != nil {
+			return nil, fmt.Errorf("bucketmap: marshal json key %v: %w", k, err)
+		}
+		strs[s] = v
+	}
+	data, err := json.Marshal(strs)
+	if err != nil {
+		return nil, fmt.Errorf("bucketmap: marshal json: %w", err)
+	}
+	return data, nil
+}
+
+// UnmarshalJSON decodes a JSON object as encoding/json decodes a map[K]V,
+// so K must be a string, an integer, or implement encoding.TextUnmarshaler;
+// otherwise an error is returned.
+// If the Map is made with KeyFromString of Options, keys are converted
+// by it instead, so K may be any type.
+// The entries are stored into the Map, keeping its buckets and other entries.
+// A zero Map, such as one allocated by encoding/json, gets default 31 buckets,
+// and no key converters.
+func (m *Map[K, V]) UnmarshalJSON(data []byte) error {
+	var entries map[K]V
+	if m.keyFromString != nil {
+		var err error
+		if entries, err = m.unmarshalStringKeys(data); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("bucketmap: unmarshal json: %w", err)
+	}
+	m.table.CompareAndSwap(nil, newTable[K, V](31, nil))
+	for k, v := range entries {
+		m.Store(k, v)
+	}
+	return nil
+}
+
+func (m *Map[K, V]) unmarshalStringKeys(data []byte) (map[K]V, error) {
+	var strs map[string]V
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return nil, fmt.Errorf("bucketmap: unmarshal json: %w", err)
+	}
+	entries := make(map[K]V, len(strs))
+	for s, v := range strs {
+		k, err := m.keyFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("bucketmap: unmarshal json key %q: %w", s, err)
+		}
+		entries[k] = v
+	}
+	return entries, nil
+}
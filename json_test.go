@@ -0,0 +1,192 @@
+package bucketmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWriteJSONLines(t *testing.T) {
+	m := Make[string, int]()
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		m.Store(k, i)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteJSONLines(&buf); err != nil {
+		t.Fatalf("write json lines: %v", err)
+	}
+
+	got := make(map[string]int)
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var line struct {
+			Key   string `json:"key"`
+			Value int    `json:"value"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("unmarshal line %q: %v", sc.Text(), err)
+		}
+		got[line.Key] = line.Value
+	}
+	if len(got) != 5 {
+		t.Fatalf("json lines: %v", got)
+	}
+	for i, k := range []string{"a", "b", "c", "d", "e"} {
+		if got[k] != i {
+			t.Fatalf("json line %v: %v", k, got[k])
+		}
+	}
+
+	bad := Make[int, func()]()
+	bad.Store(1, func() {})
+	var ute *json.UnsupportedTypeError
+	if err := bad.WriteJSONLines(&buf); !errors.As(err, &ute) {
+		t.Fatalf("write unsupported json lines: %v", err)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	m := Make[string, point](7)
+	m.Store("a", point{1, 2})
+	m.Store("b", point{3, 4})
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var plain map[string]point
+	if err = json.Unmarshal(data, &plain); err != nil {
+		t.Fatalf("unmarshal plain %s: %v", data, err)
+	}
+	if len(plain) != 2 || plain["a"] != (point{1, 2}) || plain["b"] != (point{3, 4}) {
+		t.Fatalf("unmarshal plain: %v", plain)
+	}
+
+	r := Make[string, point](5)
+	r.Store("c", point{5, 6})
+	if err = json.Unmarshal(data, r); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if r.NumBuckets() != 5 || r.Len() != 3 {
+		t.Fatalf("unmarshal: %v buckets, %v entries", r.NumBuckets(), r.Len())
+	}
+	if p, _ := r.Load("b"); p != (point{3, 4}) {
+		t.Fatalf("unmarshal b: %v", p)
+	}
+
+	var s struct {
+		M *Map[int, string]
+	}
+	if err = json.Unmarshal([]byte(`{"M":{"1":"one","2":"two"}}`), &s); err != nil {
+		t.Fatalf("unmarshal zero map: %v", err)
+	}
+	if s.M.NumBuckets() != 31 || s.M.Len() != 2 {
+		t.Fatalf("unmarshal zero map: %v buckets, %v entries", s.M.NumBuckets(), s.M.Len())
+	}
+	if v, _ := s.M.Load(2); v != "two" {
+		t.Fatalf("unmarshal zero map 2: %v", v)
+	}
+	if data, err = json.Marshal(new(Map[string, int])); err != nil || string(data) != "{}" {
+		t.Fatalf("marshal zero map: %s, %v", data, err)
+	}
+
+	p := Make[point, int]()
+	p.Store(point{1, 2}, 3)
+	if _, err = json.Marshal(p); err == nil {
+		t.Fatalf("marshal struct keys: no error")
+	}
+	if err = json.Unmarshal([]byte(`{"a":1}`), p); err == nil {
+		t.Fatalf("unmarshal struct keys: no error")
+	}
+}
+
+// textKey is a struct key encoded as text, so it can be a JSON object key.
+type textKey struct {
+	x, y int
+}
+
+func (k textKey) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", k.x, k.y)), nil
+}
+
+func (k *textKey) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "%d,%d", &k.x, &k.y)
+	return err
+}
+
+func TestMarshalJSONTextKeys(t *testing.T) {
+	m := Make[textKey, int]()
+	m.Store(textKey{1, 2}, 1)
+	m.Store(textKey{3, 4}, 2)
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	r := Make[textKey, int]()
+	if err = json.Unmarshal(data, r); err != nil {
+		t.Fatalf("unmarshal %s: %v", data, err)
+	}
+	if value, _ := r.Load(textKey{3, 4}); value != 2 || r.Len() != 2 {
+		t.Fatalf("unmarshal %s: %v", data, r.Snapshot())
+	}
+	if err = json.Unmarshal([]byte(`{"1":1}`), r); err == nil {
+		t.Fatalf("unmarshal bad key: no error")
+	}
+}
+
+func TestMarshalJSONKeyConverters(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	opts := Options[point]{
+		KeyToString: func(p point) (string, error) {
+			if p.X < 0 {
+				return "", errors.New("negative x")
+			}
+			return fmt.Sprintf("%d:%d", p.X, p.Y), nil
+		},
+		KeyFromString: func(s string) (point, error) {
+			var p point
+			_, err := fmt.Sscanf(s, "%d:%d", &p.X, &p.Y)
+			return p, err
+		},
+	}
+	m := MakeWithOptions[point, string](opts)
+	m.Store(point{1, 2}, "a")
+	m.Store(point{3, 4}, "b")
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if string(data) != `{"1:2":"a","3:4":"b"}` {
+		t.Fatalf("marshal: %s", data)
+	}
+
+	r := MakeWithOptions[point, string](opts)
+	if err = json.Unmarshal(data, r); err != nil {
+		t.Fatalf("unmarshal %s: %v", data, err)
+	}
+	if value, _ := r.Load(point{3, 4}); value != "b" || r.Len() != 2 {
+		t.Fatalf("unmarshal %s: %v", data, r.Snapshot())
+	}
+	if err = json.Unmarshal([]byte(`{"x":"c"}`), r); err == nil {
+		t.Fatalf("unmarshal bad key: no error")
+	}
+	if r.Len() != 2 {
+		t.Fatalf("unmarshal bad key: %v entries", r.Len())
+	}
+
+	m.Store(point{-1, 0}, "c")
+	if _, err = json.Marshal(m); err == nil {
+		t.Fatalf("marshal bad key: no error")
+	}
+	if data, err = json.Marshal(m.Clone()); err == nil {
+		t.Fatalf("marshal clone with bad key: %s", data)
+	}
+}
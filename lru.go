@@ -0,0 +1,385 @@
+package bucketmap
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eachain/unsafehash"
+)
+
+// LRU is a concurrent cache holding a bounded number of entries,
+// split to buckets as Map.
+// Each bucket holds an equal share of the capacity, give or take one, and evicts
+// its least recently used entry when a Store pushes it over its share,
+// so the least recently used entry of the whole LRU may outlive
+// entries of other buckets.
+//
+// An LRU made by MakeLRUCost bounds the total cost of its entries instead,
+// with a budget shared by all the buckets: a Store pushing the total cost
+// over the budget evicts the least recently used entries of its bucket,
+// and then of the other buckets, until the total is back within the budget.
+//
+// An LRU made by MakeLFU evicts the least frequently used entry of a bucket
+// instead, counting the Loads of every entry, and the least recently
+// used of the least frequently used entries on a tie.
+type LRU[K comparable, V any] struct {
+	buckets []lruBucket[K, V]
+	hash    unsafehash.HashFunc[K]
+	cost    func(K, V) int64
+	budget  int64
+	size    atomic.Int64
+	total   atomic.Int64
+
+	// shared reports whether the buckets share the budget,
+	// instead of each bucket holding its own share.
+	shared bool
+
+	// lfu reports whether the least frequently used entries are evicted,
+	// instead of the least recently used.
+	lfu bool
+
+	onEvict   atomic.Pointer[func(key K, value V)]
+	evictions evictionCounts
+}
+
+type lruBucket[K comparable, V any] struct {
+	sync.Mutex
+	m map[K]*list.Element
+
+	// ll holds the entries in the order of use, the most recent in front.
+	ll list.List
+
+	// cost is the total cost of the entries in the bucket,
+	// and share the most it may reach.
+	cost  int64
+	share int64
+}
+
+type lruEntry[K comparable, V any] struct {
+	Pair[K, V]
+	cost int64
+
+	// hits is the number of Loads of the entry since it was added.
+	hits uint64
+}
+
+// MakeLRU makes an LRU holding at most maxEntries entries, at least 1,
+// with default 31 buckets, but no more buckets than maxEntries.
+func MakeLRU[K comparable, V any](maxEntries int, buckets ...int) *LRU[K, V] {
+	maxEntries = max(maxEntries, 1)
+	c := makeLRU(int64(maxEntries), func(K, V) int64 { return 1 }, min(numBuckets(buckets), maxEntries))
+	// The remainder of the capacity goes to the first buckets,
+	// so that the shares add up to maxEntries.
+	n := len(c.buckets)
+	for i := range c.buckets {
+		c.buckets[i].share = int64(maxEntries / n)
+		if i < maxEntries%n {
+			c.buckets[i].share++
+		}
+	}
+	return c
+}
+
+// MakeLRUCost makes an LRU holding entries of at most budget total cost,
+// at least 1, as reported by cost for every entry when it is stored,
+// with default 31 buckets.
+// cost must not be negative.
+func MakeLRUCost[K comparable, V any](budget int64, cost func(K, V) int64, buckets ...int) *LRU[K, V] {
+	budget = max(budget, 1)
+	c := makeLRU(budget, cost, numBuckets(buckets))
+	c.shared = true
+	for i := range c.buckets {
+		c.buckets[i].share = budget
+	}
+	return c
+}
+
+// MakeLFU is like MakeLRU, but makes an LRU evicting
+// the least frequently used entries of a bucket first.
+// Eviction scans the bucket for the least frequently used entry,
+// so it takes time linear in the number of entries of the bucket.
+func MakeLFU[K comparable, V any](maxEntries int, buckets ...int) *LRU[K, V] {
+	c := MakeLRU[K, V](maxEntries, buckets...)
+	c.lfu = true
+	return c
+}
+
+func numBuckets(buckets []int) int {
+	if len(buckets) > 0 && buckets[0] > 0 {
+		return buckets[0]
+	}
+	return 31
+}
+
+func makeLRU[K comparable, V any](budget int64, cost func(K, V) int64, n int) *LRU[K, V] {
+	c := &LRU[K, V]{
+		buckets: make([]lruBucket[K, V], n),
+		hash:    unsafehash.Map[K](),
+		cost:    cost,
+		budget:  budget,
+	}
+	if n == 1 {
+		c.hash = func(k K) uint64 { return 0 }
+	}
+	return c
+}
+
+func (c *LRU[K, V]) index(key K) int {
+	return int(c.hash(key) % uint64(len(c.buckets)))
+}
+
+func (c *LRU[K, V]) get(key K) *lruBucket[K, V] {
+	return &c.buckets[c.index(key)]
+}
+
+// OnEvict registers fn to be called with every entry evicted for capacity,
+// replacing any fn registered before.
+// It is not called for entries deleted or overwritten, but is for entries flushed by Flush.
+// fn is called after releasing the bucket lock, so it may call into the LRU.
+func (c *LRU[K, V]) OnEvict(fn func(key K, value V)) {
+	c.onEvict.Store(&fn)
+}
+
+// Load returns the value stored for a key, or zero value if no value is present,
+// and marks the entry as the most recently used, counting one more use of it.
+// The ok result indicates whether value was found.
+func (c *LRU[K, V]) Load(key K) (value V, ok bool) {
+	bkt := c.get(key)
+	bkt.Lock()
+	defer bkt.Unlock()
+	e, ok := bkt.m[key]
+	if !ok {
+		return
+	}
+	bkt.ll.MoveToFront(e)
+	entry := e.Value.(*lruEntry[K, V])
+	entry.hits++
+	return entry.Value, true
+}
+
+// Frequency returns the number of Loads of the entry for a key since it was stored,
+// kept by Store overwriting it.
+// The ok result indicates whether the key was found.
+func (c *LRU[K, V]) Frequency(key K) (hits uint64, ok bool) {
+	bkt := c.get(key)
+	bkt.Lock()
+	defer bkt.Unlock()
+	e, ok := bkt.m[key]
+	if !ok {
+		return
+	}
+	return e.Value.(*lruEntry[K, V]).hits, true
+}
+
+// Peek is like Load, but leaves the order of use unchanged.
+func (c *LRU[K, V]) Peek(key K) (value V, ok bool) {
+	bkt := c.get(key)
+	bkt.Lock()
+	defer bkt.Unlock()
+	e, ok := bkt.m[key]
+	if !ok {
+		return
+	}
+	return e.Value.(*lruEntry[K, V]).Value, true
+}
+
+// Store sets the value for a key, and marks the entry as the most recently used.
+// If the bucket of the key is pushed over its share of the capacity,
+// or the LRU over its budget if made by MakeLRUCost,
+// the least recently used entries are evicted until it is back within it.
+// The new entry is never evicted for others, but is evicted right away
+// if it alone costs more than the share, or the budget.
+func (c *LRU[K, V]) Store(key K, value V) {
+	c.Swap(key, value)
+}
+
+// Swap is like Store, but also returns the previous value if any.
+// The loaded result reports whether the key was present.
+func (c *LRU[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	cost := c.cost(key, value)
+	i := c.index(key)
+	bkt := &c.buckets[i]
+	bkt.Lock()
+	e, ok := bkt.m[key]
+	if ok {
+		entry := e.Value.(*lruEntry[K, V])
+		previous, loaded = entry.Value, true
+		c.account(bkt, cost-entry.cost, 0)
+		entry.Value, entry.cost = value, cost
+		bkt.ll.MoveToFront(e)
+	} else {
+		if bkt.m == nil {
+			bkt.m = make(map[K]*list.Element)
+		}
+		e = bkt.ll.PushFront(&lruEntry[K, V]{Pair: Pair[K, V]{key, value}, cost: cost})
+		bkt.m[key] = e
+		c.account(bkt, cost, 1)
+	}
+	var evicted []Pair[K, V]
+	if cost > bkt.share {
+		evicted = append(evicted, c.evict(bkt, e))
+	}
+	for bkt.cost > bkt.share || c.over() {
+		victim := c.victim(bkt, e)
+		if victim == nil {
+			break
+		}
+		evicted = append(evicted, c.evict(bkt, victim))
+	}
+	bkt.Unlock()
+
+	// Other buckets are locked one at a time, after releasing bkt,
+	// so that Stores evicting from each other's buckets never deadlock.
+	for j := 1; j < len(c.buckets) && c.over(); j++ {
+		other := &c.buckets[(i+j)%len(c.buckets)]
+		other.Lock()
+		for other.ll.Len() > 0 && c.over() {
+			evicted = append(evicted, c.evict(other, c.victim(other, nil)))
+		}
+		other.Unlock()
+	}
+
+	c.evictions.capacity.Add(uint64(len(evicted)))
+	if fn := c.onEvict.Load(); fn != nil && *fn != nil {
+		for _, p := range evicted {
+			(*fn)(p.Key, p.Value)
+		}
+	}
+	return
+}
+
+// over reports whether the buckets share the budget, and it is exceeded.
+func (c *LRU[K, V]) over() bool {
+	return c.shared && c.total.Load() > c.budget
+}
+
+// victim returns the entry of bkt to evict next, other than except,
+// or nil if there is none.
+// It must be called with bkt locked.
+func (c *LRU[K, V]) victim(bkt *lruBucket[K, V], except *list.Element) *list.Element {
+	var victim *list.Element
+	var hits uint64
+	for e := bkt.ll.Back(); e != nil; e = e.Prev() {
+		if e == except {
+			continue
+		}
+		if !c.lfu {
+			return e
+		}
+		if h := e.Value.(*lruEntry[K, V]).hits; victim == nil || h < hits {
+			victim, hits = e, h
+		}
+	}
+	return victim
+}
+
+// evict removes e from bkt, and returns its entry.
+// It must be called with bkt locked.
+func (c *LRU[K, V]) evict(bkt *lruBucket[K, V], e *list.Element) Pair[K, V] {
+	entry := bkt.ll.Remove(e).(*lruEntry[K, V])
+	delete(bkt.m, entry.Key)
+	c.account(bkt, -entry.cost, -1)
+	return entry.Pair
+}
+
+// account adds cost and entries to the totals of bkt and the LRU.
+// It must be called with bkt locked.
+func (c *LRU[K, V]) account(bkt *lruBucket[K, V], cost int64, entries int64) {
+	bkt.cost += cost
+	c.total.Add(cost)
+	if entries != 0 {
+		c.size.Add(entries)
+	}
+}
+
+// Delete deletes the value for a key.
+func (c *LRU[K, V]) Delete(key K) {
+	bkt := c.get(key)
+	bkt.Lock()
+	defer bkt.Unlock()
+	if e, ok := bkt.m[key]; ok {
+		c.evict(bkt, e)
+		c.evictions.manual.Add(1)
+	}
+}
+
+// IterLRU returns an iterator over the entries from the least recently used
+// to the most recently used, leaving the order of use unchanged.
+// The order of use is tracked per bucket, so the order across buckets
+// is only approximate: the buckets are copied one by one, each under its lock,
+// and then their entries are interleaved, the least recently used of every bucket
+// first, then the second least recently used of every bucket, and so on.
+func (c *LRU[K, V]) IterLRU() func(yield func(K, V) bool) {
+	return func(yield func(K, V) bool) {
+		lists := make([][]Pair[K, V], len(c.buckets))
+		longest := 0
+		for i := range c.buckets {
+			bkt := &c.buckets[i]
+			bkt.Lock()
+			pairs := make([]Pair[K, V], 0, bkt.ll.Len())
+			for e := bkt.ll.Back(); e != nil; e = e.Prev() {
+				pairs = append(pairs, e.Value.(*lruEntry[K, V]).Pair)
+			}
+			bkt.Unlock()
+			lists[i] = pairs
+			longest = max(longest, len(pairs))
+		}
+		for rank := 0; rank < longest; rank++ {
+			for _, pairs := range lists {
+				if rank < len(pairs) && !yield(pairs[rank].Key, pairs[rank].Value) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// EvictionStats returns the numbers of entries evicted for capacity,
+// and deleted by Delete. An LRU never expires entries, so expired is zero.
+func (c *LRU[K, V]) EvictionStats() (expired, capacity, manual uint64) {
+	return c.evictions.stats()
+}
+
+// Flush deletes all the entries, resets the eviction stats,
+// and then calls the OnEvict callback for every entry deleted.
+// The buckets are emptied one at a time, each under its lock,
+// so entries stored meanwhile into buckets emptied already are kept,
+// and evictions counted meanwhile may be reset too.
+func (c *LRU[K, V]) Flush() {
+	var flushed []Pair[K, V]
+	for i := range c.buckets {
+		bkt := &c.buckets[i]
+		bkt.Lock()
+		for e := bkt.ll.Back(); e != nil; e = e.Prev() {
+			flushed = append(flushed, e.Value.(*lruEntry[K, V]).Pair)
+		}
+		c.account(bkt, -bkt.cost, -int64(bkt.ll.Len()))
+		bkt.m = nil
+		bkt.ll.Init()
+		bkt.Unlock()
+	}
+	c.evictions.reset()
+	if fn := c.onEvict.Load(); fn != nil && *fn != nil {
+		for _, p := range flushed {
+			(*fn)(p.Key, p.Value)
+		}
+	}
+}
+
+// Len returns the number of entries in the LRU.
+func (c *LRU[K, V]) Len() int {
+	return int(c.size.Load())
+}
+
+// Cost returns the total cost of the entries in the LRU,
+// the same as Len for an LRU made by MakeLRU.
+func (c *LRU[K, V]) Cost() int64 {
+	return c.total.Load()
+}
+
+// Cap returns the maximum total cost of the entries the LRU holds.
+// For an LRU made by MakeLRU, it is the maximum number of entries.
+func (c *LRU[K, V]) Cap() int {
+	return int(c.budget)
+}
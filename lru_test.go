@@ -0,0 +1,283 @@
+package bucketmap
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := MakeLRU[int, int](3, 1)
+	var evicted []int
+	c.OnEvict(func(key, value int) {
+		c.Load(key) // the bucket lock is released
+		evicted = append(evicted, key)
+	})
+	c.Store(1, 1)
+	c.Store(2, 2)
+	c.Store(3, 3)
+	c.Load(1)
+	c.Peek(2)
+	c.Store(4, 4)
+	if !slices.Equal(evicted, []int{2}) {
+		t.Fatalf("evicted: %v", evicted)
+	}
+	if _, ok := c.Load(2); ok {
+		t.Fatalf("load evicted 2: ok")
+	}
+	c.Store(3, 30)
+	c.Store(5, 5)
+	if !slices.Equal(evicted, []int{2, 1}) {
+		t.Fatalf("evicted: %v", evicted)
+	}
+	if value, ok := c.Load(3); !ok || value != 30 {
+		t.Fatalf("load 3: %v, %v", value, ok)
+	}
+	c.Delete(3)
+	c.Delete(3)
+	if n := c.Len(); n != 2 {
+		t.Fatalf("len: %v", n)
+	}
+}
+
+func TestLRUCapacity(t *testing.T) {
+	c := MakeLRU[int, int](100, 4)
+	if n := c.Cap(); n != 100 {
+		t.Fatalf("cap: %v", n)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Store(i*1000+j, j)
+				c.Load(i*1000 + j/2)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := c.Len(); n > 100 {
+		t.Fatalf("len over capacity: %v", n)
+	}
+	if n := MakeLRU[int, int](2, 8).Cap(); n != 2 {
+		t.Fatalf("cap with more buckets than entries: %v", n)
+	}
+
+	c = MakeLRU[int, int](60)
+	if n := c.Cap(); n != 60 {
+		t.Fatalf("cap with a remainder: %v", n)
+	}
+	for i := 0; i < 1000; i++ {
+		c.Store(i, i)
+	}
+	if n := c.Len(); n != 60 {
+		t.Fatalf("len filled with a remainder: %v", n)
+	}
+}
+
+func TestLRUCost(t *testing.T) {
+	c := MakeLRUCost(10, func(key string, value []byte) int64 { return int64(len(value)) }, 1)
+	var evicted []string
+	c.OnEvict(func(key string, value []byte) {
+		evicted = append(evicted, key)
+	})
+	c.Store("a", make([]byte, 4))
+	c.Store("b", make([]byte, 4))
+	if n := c.Cost(); n != 8 {
+		t.Fatalf("cost: %v", n)
+	}
+	if previous, loaded := c.Swap("a", make([]byte, 2)); !loaded || len(previous) != 4 {
+		t.Fatalf("swap a: %v, %v", previous, loaded)
+	}
+	if n := c.Cost(); n != 6 {
+		t.Fatalf("cost after swap: %v", n)
+	}
+	c.Store("c", make([]byte, 6))
+	if !slices.Equal(evicted, []string{"b"}) {
+		t.Fatalf("evicted: %v", evicted)
+	}
+	if n, cost := c.Len(), c.Cost(); n != 2 || cost != 8 {
+		t.Fatalf("len, cost: %v, %v", n, cost)
+	}
+	c.Store("d", make([]byte, 11))
+	if !slices.Equal(evicted, []string{"b", "d"}) {
+		t.Fatalf("evicted over budget: %v", evicted)
+	}
+	if n, cost := c.Len(), c.Cost(); n != 2 || cost != 8 {
+		t.Fatalf("len, cost after eviction: %v, %v", n, cost)
+	}
+	c.Delete("a")
+	c.Delete("c")
+	if n := c.Cost(); n != 0 {
+		t.Fatalf("cost after delete: %v", n)
+	}
+	if n := c.Cap(); n != 10 {
+		t.Fatalf("cap: %v", n)
+	}
+}
+
+func TestLRUCostSharedBudget(t *testing.T) {
+	c := MakeLRUCost(1000, func(key, value int) int64 { return int64(value) })
+	for i := 0; i < 100; i++ {
+		c.Store(i, 40)
+	}
+	if n, cost := c.Len(), c.Cost(); n != 25 || cost != 1000 {
+		t.Fatalf("len, cost: %v, %v", n, cost)
+	}
+	for i := 0; i < 100; i++ {
+		c.Store(i, i*7%300+1)
+		if _, ok := c.Peek(i); !ok {
+			t.Fatalf("%v evicted right after store", i)
+		}
+		if cost := c.Cost(); cost > 1000 {
+			t.Fatalf("cost over budget: %v", cost)
+		}
+	}
+	c.Store(100, 1000)
+	if n, cost := c.Len(), c.Cost(); n != 1 || cost != 1000 {
+		t.Fatalf("len, cost with the whole budget: %v, %v", n, cost)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Store(i*1000+j, j%100+1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cost := c.Cost(); cost > 1000 {
+		t.Fatalf("cost over budget after concurrent stores: %v", cost)
+	}
+}
+
+func TestIterLRU(t *testing.T) {
+	c := MakeLRU[int, int](10, 1)
+	for i := 0; i < 5; i++ {
+		c.Store(i, i)
+	}
+	c.Load(1)
+	c.Store(3, 30)
+	var keys []int
+	c.IterLRU()(func(k, v int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if !slices.Equal(keys, []int{0, 2, 4, 1, 3}) {
+		t.Fatalf("iter lru: %v", keys)
+	}
+	keys = keys[:0]
+	c.IterLRU()(func(k, v int) bool {
+		keys = append(keys, k)
+		return len(keys) < 2
+	})
+	if !slices.Equal(keys, []int{0, 2}) {
+		t.Fatalf("iter lru with early exit: %v", keys)
+	}
+
+	// Across buckets, the least recently used entries come first on average.
+	c = MakeLRU[int, int](1000, 8)
+	for i := 0; i < 1000; i++ {
+		c.Store(i, i)
+	}
+	for i := 0; i < 500; i++ {
+		c.Load(i)
+	}
+	var cold, hot, pos int
+	c.IterLRU()(func(k, v int) bool {
+		if k < 500 {
+			hot += pos
+		} else {
+			cold += pos
+		}
+		pos++
+		return true
+	})
+	if pos != c.Len() || cold >= hot {
+		t.Fatalf("iter lru across buckets: %v entries, positions of cold %v, hot %v", pos, cold, hot)
+	}
+}
+
+func TestLRUEvictionStats(t *testing.T) {
+	c := MakeLRU[int, int](2, 1)
+	for i := 0; i < 5; i++ {
+		c.Store(i, i)
+	}
+	c.Delete(4)
+	c.Delete(4)
+	if expired, capacity, manual := c.EvictionStats(); expired != 0 || capacity != 3 || manual != 1 {
+		t.Fatalf("eviction stats: %v, %v, %v", expired, capacity, manual)
+	}
+}
+
+func TestLRUFlush(t *testing.T) {
+	c := MakeLRU[int, int](3, 1)
+	for i := 0; i < 5; i++ {
+		c.Store(i, i)
+	}
+	c.Delete(4)
+	flushed := make(map[int]int)
+	c.OnEvict(func(key, value int) {
+		flushed[key] = value
+		if c.Len() != 0 {
+			t.Fatalf("lru len during flush: %v", c.Len())
+		}
+	})
+	c.Flush()
+	if len(flushed) != 2 || flushed[2] != 2 || flushed[3] != 3 {
+		t.Fatalf("flushed: %v", flushed)
+	}
+	if c.Len() != 0 || c.Cost() != 0 {
+		t.Fatalf("lru len: %v, cost: %v", c.Len(), c.Cost())
+	}
+	if _, ok := c.Load(2); ok {
+		t.Fatalf("lru load flushed key ok")
+	}
+	if expired, capacity, manual := c.EvictionStats(); expired != 0 || capacity != 0 || manual != 0 {
+		t.Fatalf("eviction stats: %v, %v, %v", expired, capacity, manual)
+	}
+	c.Store(5, 5)
+	if v, ok := c.Load(5); !ok || v != 5 || c.Len() != 1 {
+		t.Fatalf("lru load after flush: %v, %v, len: %v", v, ok, c.Len())
+	}
+}
+
+func TestLFU(t *testing.T) {
+	c := MakeLFU[int, int](3, 1)
+	for i := 0; i < 3; i++ {
+		c.Store(i, i)
+	}
+	for i := 0; i < 3; i++ {
+		c.Load(0)
+		c.Load(2)
+	}
+	c.Load(1)
+	// 1 is the least frequently used, though 0 is the least recently used.
+	c.Store(3, 3)
+	if _, ok := c.Peek(1); ok {
+		t.Fatalf("lfu rarely used entry not evicted")
+	}
+	for _, k := range []int{0, 2, 3} {
+		if _, ok := c.Peek(k); !ok {
+			t.Fatalf("lfu entry %v evicted", k)
+		}
+	}
+	if n, ok := c.Frequency(0); !ok || n != 3 {
+		t.Fatalf("lfu frequency: %v, %v", n, ok)
+	}
+	// The new entry 3 is never used, but is not evicted for 4.
+	c.Store(4, 4)
+	if _, ok := c.Peek(3); ok {
+		t.Fatalf("lfu unused entry not evicted")
+	}
+	if n, ok := c.Frequency(4); !ok || n != 0 {
+		t.Fatalf("lfu frequency of new entry: %v, %v", n, ok)
+	}
+	if _, ok := c.Frequency(1); ok {
+		t.Fatalf("lfu frequency of evicted entry ok")
+	}
+}
@@ -0,0 +1,77 @@
+package bucketmap
+
+import (
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of runtime metrics of a Map.
+type Metrics struct {
+	// Hits and Misses count the calls to Load finding a value or not.
+	// Stores counts the values stored, and Deletes the entries deleted,
+	// in bulk too, as by Clear, SwapOut and DrainTo.
+	// They are counted only if the Map is made with CountOps.
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Stores  int64 `json:"stores"`
+	Deletes int64 `json:"deletes"`
+
+	Entries     int   `json:"entries"`
+	BucketSizes []int `json:"bucket_sizes"`
+
+	// TotalWait and MaxWait are measured only
+	// if the Map is made with MeasureWait, as reported by WaitStats.
+	TotalWait time.Duration `json:"total_wait"`
+	MaxWait   time.Duration `json:"max_wait"`
+}
+
+type opCounts struct {
+	hits, misses, stores, deletes atomic.Int64
+}
+
+func (c *opCounts) load(hit bool) {
+	if hit {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// Metrics returns the current metrics of the Map,
+// to be exported by a metrics collector, such as one of Prometheus.
+func (m *Map[K, V]) Metrics() Metrics {
+	totalWait, maxWait := m.WaitStats()
+	return Metrics{
+		Hits:        m.ops.hits.Load(),
+		Misses:      m.ops.misses.Load(),
+		Stores:      m.ops.stores.Load(),
+		Deletes:     m.ops.deletes.Load(),
+		Entries:     m.Len(),
+		BucketSizes: m.BucketSizes(),
+		TotalWait:   totalWait,
+		MaxWait:     maxWait,
+	}
+}
+
+// Var returns an expvar.Var reporting the Metrics of the Map as JSON,
+// to be published by expvar.Publish.
+func (m *Map[K, V]) Var() expvar.Var {
+	return expvar.Func(func() any { return m.Metrics() })
+}
+
+// evictionCounts counts the entries removed from a cache by reason,
+// as reported by EvictionStats of LRU and ExpiringMap.
+type evictionCounts struct {
+	expired, capacity, manual atomic.Uint64
+}
+
+func (c *evictionCounts) stats() (expired, capacity, manual uint64) {
+	return c.expired.Load(), c.capacity.Load(), c.manual.Load()
+}
+
+func (c *evictionCounts) reset() {
+	c.expired.Store(0)
+	c.capacity.Store(0)
+	c.manual.Store(0)
+}
@@ -0,0 +1,50 @@
+package bucketmap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := MakeWithOptions[string, int](Options[string]{Buckets: 4, CountOps: true})
+	m.Store("a", 1)
+	m.Store("a", 2)
+	m.Store("b", 3)
+	m.Load("a")
+	m.Load("c")
+	m.Delete("b")
+	m.Delete("b")
+
+	metrics := m.Metrics()
+	if metrics.Hits != 1 || metrics.Misses != 1 || metrics.Stores != 3 || metrics.Deletes != 1 {
+		t.Fatalf("metrics: %+v", metrics)
+	}
+	if metrics.Entries != 1 || len(metrics.BucketSizes) != 4 {
+		t.Fatalf("metrics: %+v", metrics)
+	}
+
+	m.Store("c", 4)
+	m.Store("d", 5)
+	m.SwapOut()
+	m.Store("e", 6)
+	m.Clear()
+	if n := m.Metrics().Deletes; n != 5 {
+		t.Fatalf("deletes in bulk: %v", n)
+	}
+	m.Store("a", 2)
+
+	var exported Metrics
+	if err := json.Unmarshal([]byte(m.Var().String()), &exported); err != nil {
+		t.Fatalf("unmarshal var %s: %v", m.Var().String(), err)
+	}
+	if exported.Hits != 1 || exported.Stores != 7 || exported.Entries != 1 {
+		t.Fatalf("var: %+v", exported)
+	}
+
+	u := Make[string, int]()
+	u.Store("a", 1)
+	u.Load("a")
+	if metrics := u.Metrics(); metrics.Hits != 0 || metrics.Stores != 0 || metrics.Entries != 1 {
+		t.Fatalf("metrics without counting: %+v", metrics)
+	}
+}
@@ -0,0 +1,75 @@
+package bucketmap
+
+import "slices"
+
+// MultiMap is a Map holding a list of values for each key.
+//
+// The values of a key are changed while its bucket is write locked,
+// so concurrent Appends to a key are never lost.
+// A key is present as long as it holds at least one value.
+type MultiMap[K comparable, V any] struct {
+	m *Map[K, []V]
+}
+
+// MakeMulti makes a MultiMap with default 31 buckets.
+func MakeMulti[K comparable, V any](buckets ...int) *MultiMap[K, V] {
+	return &MultiMap[K, V]{m: Make[K, []V](buckets...)}
+}
+
+// Append appends value to the values of a key.
+func (x *MultiMap[K, V]) Append(key K, value V) {
+	x.m.Update(key, func(old []V, loaded bool) ([]V, Op) {
+		return append(old, value), OpStore
+	})
+}
+
+// LoadAll returns a copy of the values of a key in the order they were appended,
+// or nil if the key is not present.
+func (x *MultiMap[K, V]) LoadAll(key K) []V {
+	bkt, key := x.m.rlock(key)
+	defer bkt.RUnlock()
+	return slices.Clone(bkt.m[key])
+}
+
+// RemoveValue removes the values of a key for which pred reports true,
+// deleting the key if no value is left, and returns the number of values removed.
+// pred must not call back into the MultiMap, or it deadlocks.
+func (x *MultiMap[K, V]) RemoveValue(key K, pred func(V) bool) (removed int) {
+	x.m.Update(key, func(old []V, loaded bool) ([]V, Op) {
+		// Values are kept in a new slice, leaving old intact for any copy of it.
+		var kept []V
+		for _, v := range old {
+			if pred(v) {
+				removed++
+			} else {
+				kept = append(kept, v)
+			}
+		}
+		switch {
+		case removed == 0:
+			return old, OpKeep
+		case len(kept) == 0:
+			return nil, OpDelete
+		default:
+			return kept, OpStore
+		}
+	})
+	return
+}
+
+// CountValues returns the number of values of a key.
+func (x *MultiMap[K, V]) CountValues(key K) int {
+	bkt, key := x.m.rlock(key)
+	defer bkt.RUnlock()
+	return len(bkt.m[key])
+}
+
+// Delete deletes a key and all its values.
+func (x *MultiMap[K, V]) Delete(key K) {
+	x.m.Delete(key)
+}
+
+// Len returns the number of keys in the MultiMap.
+func (x *MultiMap[K, V]) Len() int {
+	return x.m.Len()
+}
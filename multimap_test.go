@@ -0,0 +1,66 @@
+package bucketmap
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestMultiMap(t *testing.T) {
+	m := MakeMulti[string, int]()
+	m.Append("a", 1)
+	m.Append("a", 2)
+	m.Append("a", 3)
+	m.Append("b", 4)
+	if values := m.LoadAll("a"); !slices.Equal(values, []int{1, 2, 3}) {
+		t.Fatalf("load all a: %v", values)
+	}
+	if values := m.LoadAll("c"); values != nil {
+		t.Fatalf("load all c: %v", values)
+	}
+	if n := m.CountValues("a"); n != 3 {
+		t.Fatalf("count a: %v", n)
+	}
+
+	values := m.LoadAll("a")
+	values[0] = 10
+	if n := m.RemoveValue("a", func(v int) bool { return v%2 == 1 }); n != 2 {
+		t.Fatalf("removed from a: %v", n)
+	}
+	if values := m.LoadAll("a"); !slices.Equal(values, []int{2}) {
+		t.Fatalf("load all a after remove: %v", values)
+	}
+	if n := m.RemoveValue("a", func(v int) bool { return v > 100 }); n != 0 {
+		t.Fatalf("removed none from a: %v", n)
+	}
+	m.RemoveValue("b", func(int) bool { return true })
+	if n := m.Len(); n != 1 {
+		t.Fatalf("len after removing all of b: %v", n)
+	}
+	m.Delete("a")
+	if n := m.CountValues("a"); n != 0 || m.Len() != 0 {
+		t.Fatalf("count a after delete: %v, len %v", n, m.Len())
+	}
+}
+
+func TestMultiMapConcurrentAppend(t *testing.T) {
+	m := MakeMulti[int, int](4)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Append(j%3, i*100+j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for k := 0; k < 3; k++ {
+		total += m.CountValues(k)
+	}
+	if total != 800 {
+		t.Fatalf("values appended: %v", total)
+	}
+}
@@ -0,0 +1,77 @@
+package bucketmap
+
+// Set is a set of keys, safe for concurrent use like Map,
+// which it is built on with empty values taking no space.
+type Set[K comparable] struct {
+	m *Map[K, struct{}]
+}
+
+// MakeSet makes a Set with default 31 buckets.
+func MakeSet[K comparable](buckets ...int) *Set[K] {
+	return &Set[K]{Make[K, struct{}](buckets...)}
+}
+
+// Add adds key to the Set, and reports whether it was absent.
+func (s *Set[K]) Add(key K) (added bool) {
+	_, loaded := s.m.LoadOrStore(key, struct{}{})
+	return !loaded
+}
+
+// Remove removes key from the Set, and reports whether it was present.
+func (s *Set[K]) Remove(key K) (removed bool) {
+	_, removed = s.m.LoadAndDelete(key)
+	return
+}
+
+// Contains reports whether key is in the Set.
+func (s *Set[K]) Contains(key K) bool {
+	_, ok := s.m.Load(key)
+	return ok
+}
+
+// Len returns the number of keys in the Set.
+func (s *Set[K]) Len() int {
+	return s.m.Len()
+}
+
+// Iter returns an iterator over the keys in the Set, as Map.Iter.
+func (s *Set[K]) Iter() func(yield func(K) bool) {
+	return func(yield func(K) bool) {
+		s.m.Iter()(func(k K, _ struct{}) bool {
+			return yield(k)
+		})
+	}
+}
+
+// Union returns a new Set of the keys in s or other,
+// with as many buckets as s.
+func (s *Set[K]) Union(other *Set[K]) *Set[K] {
+	u := MakeSet[K](s.m.NumBuckets())
+	u.m.StoreMany(s.m.Snapshot())
+	u.m.StoreMany(other.m.Snapshot())
+	return u
+}
+
+// Intersect returns a new Set of the keys in both s and other,
+// with as many buckets as s.
+func (s *Set[K]) Intersect(other *Set[K]) *Set[K] {
+	return s.filter(other, true)
+}
+
+// Diff returns a new Set of the keys in s but not in other,
+// with as many buckets as s.
+func (s *Set[K]) Diff(other *Set[K]) *Set[K] {
+	return s.filter(other, false)
+}
+
+// filter returns a new Set of the keys in s whose presence in other is in.
+func (s *Set[K]) filter(other *Set[K], in bool) *Set[K] {
+	f := MakeSet[K](s.m.NumBuckets())
+	s.Iter()(func(k K) bool {
+		if other.Contains(k) == in {
+			f.Add(k)
+		}
+		return true
+	})
+	return f
+}
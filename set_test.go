@@ -0,0 +1,57 @@
+package bucketmap
+
+import (
+	"slices"
+	"testing"
+)
+
+func setOf(keys ...int) *Set[int] {
+	s := MakeSet[int](4)
+	for _, k := range keys {
+		s.Add(k)
+	}
+	return s
+}
+
+func sortedKeys(s *Set[int]) []int {
+	var keys []int
+	s.Iter()(func(k int) bool {
+		keys = append(keys, k)
+		return true
+	})
+	slices.Sort(keys)
+	return keys
+}
+
+func TestSet(t *testing.T) {
+	s := MakeSet[string]()
+	if !s.Add("a") || s.Add("a") {
+		t.Fatalf("add a twice: want true, false")
+	}
+	if !s.Contains("a") || s.Contains("b") {
+		t.Fatalf("contains a, b: want true, false")
+	}
+	if n := s.Len(); n != 1 {
+		t.Fatalf("len: %v", n)
+	}
+	if !s.Remove("a") || s.Remove("a") {
+		t.Fatalf("remove a twice: want true, false")
+	}
+	if n := s.Len(); n != 0 {
+		t.Fatalf("len after remove: %v", n)
+	}
+
+	a, b := setOf(1, 2, 3, 4), setOf(3, 4, 5)
+	if keys := sortedKeys(a.Union(b)); !slices.Equal(keys, []int{1, 2, 3, 4, 5}) {
+		t.Fatalf("union: %v", keys)
+	}
+	if keys := sortedKeys(a.Intersect(b)); !slices.Equal(keys, []int{3, 4}) {
+		t.Fatalf("intersect: %v", keys)
+	}
+	if keys := sortedKeys(a.Diff(b)); !slices.Equal(keys, []int{1, 2}) {
+		t.Fatalf("diff: %v", keys)
+	}
+	if keys := sortedKeys(a); !slices.Equal(keys, []int{1, 2, 3, 4}) {
+		t.Fatalf("a changed: %v", keys)
+	}
+}
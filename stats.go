@@ -0,0 +1,102 @@
+package bucketmap
+
+import "math/rand"
+
+// Stats describes how the entries of a Map are distributed over its buckets.
+type Stats struct {
+	// Buckets is the number of buckets of the Map.
+	Buckets int
+
+	// Sampled is the number of buckets the statistics are computed from.
+	// It is less than Buckets if the statistics are sampled.
+	Sampled int
+
+	// Entries is the number of entries, extrapolated from the sampled buckets.
+	Entries int
+
+	// Min and Max are the smallest and largest numbers of entries
+	// in a sampled bucket.
+	Min, Max int
+
+	// Mean is the average number of entries in a sampled bucket.
+	Mean float64
+}
+
+// BucketSizes returns the number of entries in each bucket, in index order.
+// Each number is read with its bucket locked for reading,
+// but the buckets are read one by one.
+func (m *Map[K, V]) BucketSizes() []int {
+	t := m.table.Load()
+	sizes := make([]int, len(t.buckets))
+	for i := range t.buckets {
+		bkt := &t.buckets[i]
+		bkt.RLock()
+		sizes[i] = len(bkt.m)
+		bkt.RUnlock()
+	}
+	return sizes
+}
+
+// Stats computes Stats from all the buckets.
+// It is the same as SampledStats(0).
+func (m *Map[K, V]) Stats() Stats {
+	return m.SampledStats(0)
+}
+
+// SampledStats computes Stats from sampleBuckets buckets chosen at random,
+// or all the buckets if sampleBuckets <= 0 or exceeds the number of buckets,
+// locking each chosen bucket for reading in turn.
+//
+// Sampling trades accuracy for speed: Mean and Entries are unbiased
+// estimates, whose error shrinks as the square root of sampleBuckets grows,
+// and is small if the keys spread evenly; but Min and Max are only bounds
+// of the sampled buckets, so a few hot buckets may well be missed.
+func (m *Map[K, V]) SampledStats(sampleBuckets int) Stats {
+	t := m.table.Load()
+	n := len(t.buckets)
+	if sampleBuckets <= 0 || sampleBuckets > n {
+		sampleBuckets = n
+	}
+
+	s := Stats{Buckets: n, Sampled: sampleBuckets}
+	sampled := 0
+	for i, j := range sample(n, sampleBuckets) {
+		bkt := &t.buckets[j]
+		bkt.RLock()
+		size := len(bkt.m)
+		bkt.RUnlock()
+		if i == 0 || size < s.Min {
+			s.Min = size
+		}
+		if size > s.Max {
+			s.Max = size
+		}
+		sampled += size
+	}
+	s.Mean = float64(sampled) / float64(sampleBuckets)
+	s.Entries = int(s.Mean*float64(n) + 0.5)
+	return s
+}
+
+// sample returns k distinct integers in [0, n) chosen at random,
+// or all of them in order if k == n.
+func sample(n, k int) []int {
+	indexes := make([]int, 0, k)
+	if k == n {
+		for i := 0; i < n; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+	// Floyd's algorithm picks each k-subset with equal probability.
+	seen := make(map[int]bool, k)
+	for j := n - k; j < n; j++ {
+		i := rand.Intn(j + 1)
+		if seen[i] {
+			i = j
+		}
+		seen[i] = true
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
@@ -0,0 +1,67 @@
+package bucketmap
+
+import "testing"
+
+func TestSampledStats(t *testing.T) {
+	m := Make[int, int](1024)
+	for i := 0; i < 100000; i++ {
+		m.Store(i, i)
+	}
+
+	full := m.SampledStats(0)
+	if full.Buckets != 1024 || full.Sampled != 1024 || full.Entries != 100000 {
+		t.Fatalf("full stats: %+v", full)
+	}
+	if full.Min > full.Max || float64(full.Min) > full.Mean || full.Mean > float64(full.Max) {
+		t.Fatalf("full stats: %+v", full)
+	}
+
+	s := m.SampledStats(256)
+	if s.Buckets != 1024 || s.Sampled != 256 {
+		t.Fatalf("sampled stats: %+v", s)
+	}
+	if s.Entries < 95000 || s.Entries > 105000 {
+		t.Fatalf("sampled entries: %v, full %v", s.Entries, full.Entries)
+	}
+	if s.Min < full.Min || s.Max > full.Max {
+		t.Fatalf("sampled stats: %+v, full %+v", s, full)
+	}
+
+	if s := Make[int, int](8).SampledStats(3); s.Entries != 0 || s.Min != 0 || s.Max != 0 {
+		t.Fatalf("sampled stats of empty map: %+v", s)
+	}
+}
+
+func TestBucketSizes(t *testing.T) {
+	m := Make[int, int](16)
+	for i := 0; i < 1000; i++ {
+		m.Store(i, i)
+	}
+	sizes := m.BucketSizes()
+	if len(sizes) != 16 {
+		t.Fatalf("bucket sizes: %v", sizes)
+	}
+	sum, lo, hi := 0, sizes[0], sizes[0]
+	for i, size := range sizes {
+		sum += size
+		lo, hi = min(lo, size), max(hi, size)
+		n := 0
+		m.Iter()(func(k, v int) bool {
+			if m.BucketIndex(k) == i {
+				n++
+			}
+			return true
+		})
+		if n != size {
+			t.Fatalf("bucket %v size: %v, want %v", i, size, n)
+		}
+	}
+	if sum != 1000 {
+		t.Fatalf("bucket sizes sum: %v", sum)
+	}
+
+	s := m.Stats()
+	if s.Buckets != 16 || s.Entries != 1000 || s.Min != lo || s.Max != hi || s.Mean != 1000.0/16 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
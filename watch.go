@@ -0,0 +1,59 @@
+package bucketmap
+
+// Event describes a change of an entry, as reported to the watcher
+// registered by Watch.
+type Event[K comparable, V any] struct {
+	// Op is OpStore if a value is stored, or OpDelete if the entry is deleted.
+	Op  Op
+	Key K
+
+	// Old is the value replaced or deleted, if Loaded reports it is present.
+	Old    V
+	Loaded bool
+
+	// New is the value stored, if Op is OpStore.
+	New V
+}
+
+// Watch registers fn to be called with an Event for every change of an entry,
+// replacing any fn registered before, or stopping watching if fn is nil.
+// Every value stored is reported as OpStore, even if unchanged,
+// as by TransformInPlace. Deletions in bulk, as by Clear, DrainTo and SwapOut,
+// and evictions, as by EvictOlderThan, are reported as OpDelete for each entry.
+// Resizing moves the entries without changing them, so it reports nothing.
+//
+// fn is called while holding the write lock of the bucket of the changed entry,
+// so that the changes of each key are reported in order,
+// and fn must not call back into the Map, or it deadlocks.
+// Changes of different buckets may be reported concurrently.
+//
+// If fn panics, the change it is called for is not made,
+// and the panic propagates after the locks are released,
+// so the Map remains usable. Changes made before it by the same call,
+// as by StoreMany or Clear, are kept, except for SwapOut and SwapKeys,
+// which report all their changes before making any, and so make none.
+func (m *Map[K, V]) Watch(fn func(Event[K, V])) {
+	if fn == nil {
+		m.watcher.Store(nil)
+		return
+	}
+	m.watcher.Store(&fn)
+}
+
+// watch returns the registered watcher, or nil if none.
+func (m *Map[K, V]) watch() func(Event[K, V]) {
+	if fn := m.watcher.Load(); fn != nil {
+		return *fn
+	}
+	return nil
+}
+
+// reportDeletes reports the deletions of entries to fn, if not nil.
+func reportDeletes[K comparable, V any](fn func(Event[K, V]), entries map[K]V) {
+	if fn == nil {
+		return
+	}
+	for k, v := range entries {
+		fn(Event[K, V]{Op: OpDelete, Key: k, Old: v, Loaded: true})
+	}
+}
@@ -0,0 +1,140 @@
+package bucketmap
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	m := Make[string, int](1)
+	var events []Event[string, int]
+	m.Watch(func(e Event[string, int]) {
+		events = append(events, e)
+	})
+	check := func(op string, want ...Event[string, int]) {
+		t.Helper()
+		if !slices.Equal(events, want) {
+			t.Fatalf("events after %v: %+v, want %+v", op, events, want)
+		}
+		events = nil
+	}
+
+	m.Store("a", 1)
+	check("store", Event[string, int]{Op: OpStore, Key: "a", New: 1})
+	m.Swap("a", 2)
+	check("swap", Event[string, int]{Op: OpStore, Key: "a", Old: 1, Loaded: true, New: 2})
+	m.Delete("a")
+	m.Delete("a")
+	check("delete", Event[string, int]{Op: OpDelete, Key: "a", Old: 2, Loaded: true})
+	m.Update("b", func(int, bool) (int, Op) { return 3, OpStore })
+	m.LoadAndDelete("b")
+	check("update",
+		Event[string, int]{Op: OpStore, Key: "b", New: 3},
+		Event[string, int]{Op: OpDelete, Key: "b", Old: 3, Loaded: true})
+
+	m.Store("c", 4)
+	events = nil
+	m.Rehash(4)
+	check("rehash")
+	m.Clear()
+	check("clear", Event[string, int]{Op: OpDelete, Key: "c", Old: 4, Loaded: true})
+
+	m.Watch(nil)
+	m.Store("d", 5)
+	check("unwatched")
+}
+
+func TestWatchPanic(t *testing.T) {
+	m := Make[int, int](4)
+	for i := 0; i < 10; i++ {
+		m.Store(i, i)
+	}
+	h := m.Prehash(1)
+	ops := map[string]func(){
+		"store":           func() { m.Store(1, 1) },
+		"delete":          func() { m.Delete(1) },
+		"load or store":   func() { m.LoadOrStore(10, 10) },
+		"load and delete": func() { m.LoadAndDelete(1) },
+		"store many":      func() { m.StoreMany(map[int]int{1: 1, 2: 2}) },
+		"delete many":     func() { m.DeleteMany([]int{1, 2}) },
+		"add many":        func() { AddMany(m, map[int]int{1: 1}) },
+		"claim any":       func() { m.ClaimAny() },
+		"store h":         func() { m.StoreH(h, 1) },
+		"replace":         func() { m.Replace(1, 1, nil) },
+		"clear":           func() { m.Clear() },
+		"swap out":        func() { m.SwapOut() },
+	}
+	for name, op := range ops {
+		m.Watch(func(Event[int, int]) { panic("boom") })
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%v: panic not propagated", name)
+				}
+			}()
+			op()
+		}()
+		m.Watch(nil)
+		for i := 0; i < 10; i++ {
+			m.Store(i, i) // would deadlock if a bucket were left locked
+		}
+		if n := m.Len(); n != 10 {
+			t.Fatalf("%v: len %v", name, n)
+		}
+	}
+
+	// Changes reported before the panic are made, the others are not.
+	m = Make[int, int](1)
+	for i := 0; i < 5; i++ {
+		m.Store(i, i)
+	}
+	var reported []int
+	m.Watch(func(e Event[int, int]) {
+		if len(reported) == 2 {
+			panic("boom")
+		}
+		reported = append(reported, e.Key)
+	})
+	mustPanic := func(name string, op func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%v: panic not propagated", name)
+			}
+		}()
+		op()
+	}
+	mustPanic("clear", m.Clear)
+	for i := 0; i < 5; i++ {
+		_, ok := m.Load(i)
+		if deleted := slices.Contains(reported, i); ok == deleted {
+			t.Fatalf("clear: %v present %v, reported %v", i, ok, reported)
+		}
+	}
+	if n := m.Len(); n != 3 {
+		t.Fatalf("clear: len %v", n)
+	}
+
+	m.Watch(nil)
+	for i := 0; i < 5; i++ {
+		m.Store(i, i)
+	}
+	reported = nil
+	m.Watch(func(e Event[int, int]) {
+		if len(reported) == 2 {
+			panic("boom")
+		}
+		reported = append(reported, e.Key)
+	})
+	mustPanic("swap out", func() { m.SwapOut() })
+	if n := m.Len(); n != 5 {
+		t.Fatalf("swap out: len %v", n)
+	}
+	reported = []int{0}
+	mustPanic("swap keys", func() { m.SwapKeys(1, 2) })
+	for i := 0; i < 5; i++ {
+		if value, _ := m.Load(i); value != i {
+			t.Fatalf("swap keys: %v holds %v", i, value)
+		}
+	}
+}